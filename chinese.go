@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// t2sPhrases are Taiwan terms whose mainland form is a different word, like
+// the OpenCC TWPhrases table. They are different words rather than spellings,
+// so documents keep them; queries search both forms (see scriptSynonyms).
+var t2sPhrases = map[string]string{
+	"軟體":    "软件",
+	"硬體":    "硬件",
+	"韌體":    "固件",
+	"記憶體":   "内存",
+	"晶片":    "芯片",
+	"網路":    "网络",
+	"網際網路":  "互联网",
+	"伺服器":   "服务器",
+	"程式":    "程序",
+	"資料":    "数据",
+	"資料庫":   "数据库",
+	"電晶體":   "晶体管",
+	"積體電路":  "集成电路",
+	"介面":    "接口",
+	"解析度":   "分辨率",
+	"螢幕":    "屏幕",
+	"滑鼠":    "鼠标",
+	"筆電":    "笔记本",
+	"訊號":    "信号",
+	"類比":    "模拟",
+	"數位":    "数字",
+	"位元":    "比特",
+	"位元組":   "字节",
+	"作業系統":  "操作系统",
+	"行動裝置":  "移动设备",
+	"智慧型手機": "智能手机",
+	"演算法":   "算法",
+	"人工智慧":  "人工智能",
+	"物聯網":   "物联网",
+	"感測器":   "传感器",
+}
+
+var (
+	t2sCharMap map[rune]rune
+
+	// phraseSynonyms maps each phrase of t2sPhrases, folded to Simplified
+	// characters, to its other form and back, e.g. 软体 <-> 软件
+	phraseSynonyms  map[string]string
+	phraseMaxLength int
+)
+
+func init() {
+	t2sCharMap = map[rune]rune{}
+	for _, pair := range strings.Fields(t2sChars) {
+		t, size := utf8.DecodeRuneInString(pair)
+		s, _ := utf8.DecodeRuneInString(pair[size:])
+		t2sCharMap[t] = s
+	}
+
+	phraseSynonyms = map[string]string{}
+	for t, s := range t2sPhrases {
+		folded := normalizeScript(t)
+		if folded == s {
+			continue
+		}
+		phraseSynonyms[folded] = s
+		phraseSynonyms[s] = folded
+		for _, p := range []string{folded, s} {
+			if n := utf8.RuneCountInString(p); n > phraseMaxLength {
+				phraseMaxLength = n
+			}
+		}
+	}
+}
+
+// normalizeScript folds Traditional Chinese characters onto Simplified so that
+// text typed in either script compares equal. Words are left alone; 資料
+// becomes 资料, not 数据. Non-Chinese text is returned unchanged.
+func normalizeScript(s string) string {
+	return strings.Map(func(r rune) rune {
+		if simp, ok := t2sCharMap[r]; ok {
+			return simp
+		}
+		return r
+	}, s)
+}
+
+// scriptSynonyms swaps the Taiwan and mainland terms of a normalized query,
+// longest match first, so "软体" also finds "软件" and the other way round.
+// It returns "" when the query has none.
+func scriptSynonyms(norm string) string {
+	runes := []rune(norm)
+	var b strings.Builder
+	b.Grow(len(norm))
+
+	swapped := false
+	for i := 0; i < len(runes); {
+		matched := false
+		for n := min(phraseMaxLength, len(runes)-i); n > 1; n-- {
+			if syn, ok := phraseSynonyms[string(runes[i:i+n])]; ok {
+				b.WriteString(syn)
+				i += n
+				matched, swapped = true, true
+				break
+			}
+		}
+		if !matched {
+			b.WriteRune(runes[i])
+			i++
+		}
+	}
+
+	if !swapped {
+		return ""
+	}
+	return b.String()
+}
+
+// scriptVariant returns the normalized text when it differs from the original,
+// so the *_norm fields are only stored for documents that need them.
+func scriptVariant(s string) string {
+	if norm := normalizeScript(s); norm != s {
+		return norm
+	}
+	return ""
+}
+
+// scriptVariants are the spellings a query is searched in besides its own:
+// the Simplified folding and the text with its Taiwan and mainland terms swapped.
+func scriptVariants(text string) []string {
+	var variants []string
+	norm := normalizeScript(text)
+	if norm != text {
+		variants = append(variants, norm)
+	}
+	if syn := scriptSynonyms(norm); syn != "" {
+		variants = append(variants, syn)
+	}
+	return variants
+}
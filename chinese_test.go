@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestNormalizeScript(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"電腦", "电脑"},
+		{"資料", "资料"},
+		{"軟體開發", "软体开发"},
+		{"USB 3.0", "USB 3.0"},
+		{"数据", "数据"},
+		{"之後", "之后"},
+		{"區塊鏈", "区块链"},
+		{"發佈", "发布"},
+		{"並寬嗎係腳樹遊乾繫憑盧彎", "并宽吗系脚树游干系凭卢弯"},
+		{"矽晶圓", "硅晶圆"},
+	}
+	for _, tt := range tests {
+		if got := normalizeScript(tt.in); got != tt.want {
+			t.Errorf("normalizeScript(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScriptSynonyms(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"软体开发", "软件开发"},
+		{"软件开发", "软体开发"},
+		{"资料库", "数据库"},
+		{"数据", "资料"},
+		{"电脑", ""},
+	}
+	for _, tt := range tests {
+		if got := scriptSynonyms(tt.in); got != tt.want {
+			t.Errorf("scriptSynonyms(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExchangeRate (Models)
+// Rate is the value of one unit of Currency in the reference currency.
+type ExchangeRate struct {
+	Currency      string
+	Rate          float64
+	EffectiveDate time.Time
+}
+
+type rateTable struct {
+	base  string
+	rates map[string][]ExchangeRate
+}
+
+var (
+	rates *rateTable
+)
+
+// loadRates reads the exchange-rate table from RatesFile (CSV) or RatesTable (pm database).
+// With neither configured the table only knows the reference currency itself.
+func loadRates() *rateTable {
+	base := strings.ToUpper(appConfig.RefCurrency)
+	if base == "" {
+		base = "USD"
+	}
+
+	var list []ExchangeRate
+	var err error
+	switch {
+	case appConfig.RatesFile != "":
+		list, err = readRatesFile(appConfig.RatesFile)
+	case appConfig.RatesTable != "":
+		list, err = readRatesTable(appConfig.RatesTable)
+	}
+	checkErr(err)
+
+	logger.Info("exchange rates loaded", "rates", len(list), "ref_currency", base)
+	return newRateTable(base, list)
+}
+
+func newRateTable(base string, list []ExchangeRate) *rateTable {
+	t := &rateTable{base: base, rates: map[string][]ExchangeRate{}}
+	for _, r := range list {
+		code := strings.ToUpper(r.Currency)
+		t.rates[code] = append(t.rates[code], r)
+	}
+	for code := range t.rates {
+		sort.Slice(t.rates[code], func(i, j int) bool {
+			return t.rates[code][i].EffectiveDate.Before(t.rates[code][j].EffectiveDate)
+		})
+	}
+	return t
+}
+
+// readRatesFile reads "currency,rate,effective_date" lines; the first record is
+// skipped as a header when its rate is not a number.
+func readRatesFile(name string) ([]ExchangeRate, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+
+	var list []ExchangeRate
+	for n := 0; ; n++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("%s: expected currency,rate,effective_date, got %v", name, rec)
+		}
+
+		rate, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			if n == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("%s: bad rate %q", name, rec[1])
+		}
+		date, err := time.Parse("2006-01-02", rec[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad effective_date %q", name, rec[2])
+		}
+		list = append(list, ExchangeRate{Currency: rec[0], Rate: rate, EffectiveDate: date})
+	}
+
+	return list, nil
+}
+
+func readRatesTable(table string) ([]ExchangeRate, error) {
+	sqlstr := fmt.Sprintf("SELECT currency, rate, effective_date FROM %s ORDER BY effective_date", table)
+
+	rows, err := dbpm.Query(sqlstr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []ExchangeRate
+	for rows.Next() {
+		var r ExchangeRate
+		if err := rows.Scan(&r.Currency, &r.Rate, &r.EffectiveDate); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+
+	return list, rows.Err()
+}
+
+// rate returns the rate in effect for code at the given time.
+func (t *rateTable) rate(code string, at time.Time) (float64, bool) {
+	code = strings.ToUpper(code)
+	if code == t.base {
+		return 1, true
+	}
+
+	found := false
+	var rate float64
+	for _, r := range t.rates[code] {
+		if r.EffectiveDate.After(at) {
+			break
+		}
+		rate = r.Rate
+		found = true
+	}
+	return rate, found && rate > 0
+}
+
+// known reports whether the table has any rate for code.
+func (t *rateTable) known(code string) bool {
+	code = strings.ToUpper(code)
+	return code == t.base || len(t.rates[code]) > 0
+}
+
+// convert converts amount between two currencies through the reference currency.
+func (t *rateTable) convert(amount float64, from string, to string, at time.Time) (float64, bool) {
+	if strings.EqualFold(from, to) {
+		return amount, true
+	}
+
+	fromRate, ok := t.rate(from, at)
+	if !ok {
+		return 0, false
+	}
+	toRate, ok := t.rate(to, at)
+	if !ok {
+		return 0, false
+	}
+	return amount * fromRate / toRate, true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadRatesFile(t *testing.T) {
+	write := func(content string) string {
+		name := filepath.Join(t.TempDir(), "rates.csv")
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	list, err := readRatesFile(write("currency,rate,effective_date\n# comment\nTWD,0.031,2024-01-01\nEUR,1.09,2024-01-01\n"))
+	if err != nil {
+		t.Fatalf("with header: %v", err)
+	}
+	if len(list) != 2 {
+		t.Errorf("with header: got %d rates, want 2", len(list))
+	}
+
+	if _, err := readRatesFile(write("TWD,0.031,2024-01-01\nEUR,n/a,2024-01-01\n")); err == nil {
+		t.Error("bad rate after the first record was accepted")
+	}
+	if _, err := readRatesFile(write("currency,rate,effective_date\nTWD,n/a,2024-01-01\nEUR,1.09,2024-01-01\n")); err == nil {
+		t.Error("bad rate after the header was skipped as a second header")
+	}
+}
+
+func TestHandleProductSearchRejectsUnknownCurrency(t *testing.T) {
+	saved := rates
+	defer func() { rates = saved }()
+	rates = newRateTable("USD", nil)
+
+	for _, url := range []string{
+		"/search/product?q=usb&currency=XYZ",
+		"/search/product?q=usb&currency=XYZ&min_price=1",
+	} {
+		w := httptest.NewRecorder()
+		handleProductSearch(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", url, w.Code, http.StatusBadRequest)
+		}
+	}
+}
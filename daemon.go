@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robfig/cron/v3"
+)
+
+// RUN_HISTORY_FILE is where finished runs are appended, one JSON object per line
+const RUN_HISTORY_FILE = "run_history.jsonl"
+
+// HISTORY_SIZE is the number of runs kept in memory for /status and /history
+const HISTORY_SIZE = 100
+
+// JobSchedule (Models)
+type JobSchedule struct {
+	Job  string
+	Cron string
+}
+
+// RunRecord (Models)
+type RunRecord struct {
+	RunID    string    `json:"run_id"`
+	Job      string    `json:"job"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// JobStatus (Models)
+type JobStatus struct {
+	Job     string     `json:"job"`
+	Cron    string     `json:"cron"`
+	Next    time.Time  `json:"next"`
+	Running bool       `json:"running"`
+	Queued  bool       `json:"queued"`
+	Last    *RunRecord `json:"last,omitempty"`
+
+	entry cron.EntryID
+}
+
+type daemon struct {
+	cron *cron.Cron
+
+	// ctx is cancelled on SIGINT or SIGTERM and is the parent of every run
+	ctx context.Context
+
+	// run admits one indexing run at a time; jobs share the DB pools,
+	// the bulk pipeline and jobProgress
+	run sync.Mutex
+
+	mu      sync.Mutex
+	jobs    map[string]*JobStatus
+	order   []string
+	history []RunRecord
+	started time.Time
+}
+
+// runDaemon runs the jobs listed in Schedules until SIGINT or SIGTERM:
+//
+//	[[Prod.Schedules]]
+//	job = "product-incremental"
+//	cron = "*/5 * * * *"
+//
+// A run that fires while the same job is running or waiting, here or on
+// another instance (see runLocked), is skipped; other jobs wait for the
+// running one to finish. Health and run status are served on Listen.
+func runDaemon() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	d := &daemon{
+		ctx:     ctx,
+		cron:    cron.New(),
+		jobs:    map[string]*JobStatus{},
+		started: time.Now(),
+	}
+
+	for _, s := range appConfig.Schedules {
+		if _, ok := jobs[s.Job]; !ok {
+			checkErr(fmt.Errorf("schedule for unknown job %q", s.Job))
+		}
+		if _, ok := d.jobs[s.Job]; ok {
+			checkErr(fmt.Errorf("job %q is scheduled twice", s.Job))
+		}
+
+		job := s.Job
+		id, err := d.cron.AddFunc(s.Cron, func() { d.trigger(job) })
+		checkErr(err)
+
+		d.jobs[job] = &JobStatus{Job: job, Cron: s.Cron, entry: id}
+		d.order = append(d.order, job)
+	}
+	if len(d.jobs) == 0 {
+		logger.Warn("no schedules configured, daemon only serves health checks")
+	}
+
+	d.loadHistory()
+	d.cron.Start()
+	logger.Info("daemon started", "jobs", d.order)
+
+	addr := appConfig.Listen
+	if addr == "" {
+		addr = ":8080"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.handleHealth)
+	mux.HandleFunc("/readyz", d.handleReady)
+	mux.HandleFunc("/status", d.handleStatus)
+	mux.HandleFunc("/history", d.handleHistory)
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		logger.Info("daemon API listening", "addr", addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			checkErr(err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	logger.Info("shutting down, cancelling running jobs")
+	server.Shutdown(context.Background())
+	<-d.cron.Stop().Done()
+}
+
+func (d *daemon) trigger(job string) {
+	d.mu.Lock()
+	st := d.jobs[job]
+	if st.Running || st.Queued {
+		d.mu.Unlock()
+		now := time.Now()
+		logger.Warn("previous run still active, skipping", "job", job)
+		d.record(RunRecord{RunID: newRunID(), Job: job, Start: now, End: now, Status: "skipped", Error: "previous run still active"})
+		return
+	}
+	st.Queued = true
+	d.mu.Unlock()
+
+	d.run.Lock()
+	defer d.run.Unlock()
+
+	d.mu.Lock()
+	st.Queued = false
+	st.Running = true
+	d.mu.Unlock()
+
+	rec := d.execute(job)
+
+	d.mu.Lock()
+	st.Running = false
+	st.Last = &rec
+	d.mu.Unlock()
+
+	d.record(rec)
+}
+
+// execute runs one job with its own run id. Panics that escape the job, or
+// that a batch recovered from, mark the run failed.
+func (d *daemon) execute(job string) (rec RunRecord) {
+	rec = RunRecord{RunID: newRunID(), Job: job, Start: time.Now(), Status: "ok"}
+
+	// the process logger is shared with the HTTP handlers; a run logs through its own
+	log := baseLogger.With("run_id", rec.RunID, "job", job)
+
+	ctx, span := tracer.Start(d.ctx, job)
+	defer span.End()
+
+	ctx, panics := withPanicCounter(ctx)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(ctx, log, r)
+				markFailed(span, r)
+				rec.Error = fmt.Sprint(r)
+			}
+		}()
+		log.Info("run started")
+		// runs are serialized by d.run, so no other job reads these meanwhile
+		loadReferenceData()
+		run := jobs[job]
+		if err := runLocked(ctx, log, job, func(ctx context.Context) { run(ctx, log) }); err != nil {
+			rec.Error = err.Error()
+			if errors.Is(err, errLocked) || errors.Is(err, errLockUnavailable) {
+				rec.Status = "skipped"
+			}
+		}
+	}()
+
+	if n := panics.Load(); n > 0 && rec.Error == "" {
+		rec.Error = fmt.Sprintf("%d batches failed", n)
+	}
+	if rec.Error != "" && rec.Status != "skipped" {
+		rec.Status = "failed"
+	}
+	rec.End = time.Now()
+	rec.Duration = rec.End.Sub(rec.Start).Round(time.Millisecond).String()
+
+	log.Info("run finished", "status", rec.Status, "elapsed", rec.Duration, "err", rec.Error)
+	return rec
+}
+
+func (d *daemon) record(rec RunRecord) {
+	d.mu.Lock()
+	d.history = append(d.history, rec)
+	if len(d.history) > HISTORY_SIZE {
+		d.history = d.history[len(d.history)-HISTORY_SIZE:]
+	}
+	d.mu.Unlock()
+
+	f, err := os.OpenFile(historyFileName(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Warn("cannot write run history", "err", err)
+		return
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(rec)
+}
+
+// loadHistory restores the last runs, so a restart keeps the last-run status.
+func (d *daemon) loadHistory() {
+	f, err := os.Open(historyFileName())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec RunRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		d.history = append(d.history, rec)
+		if len(d.history) > HISTORY_SIZE {
+			d.history = d.history[1:]
+		}
+		if st, ok := d.jobs[rec.Job]; ok && rec.Status != "skipped" {
+			r := rec
+			st.Last = &r
+		}
+	}
+}
+
+func historyFileName() string {
+	if appConfig.RunHistoryFile != "" {
+		return appConfig.RunHistoryFile
+	}
+	return RUN_HISTORY_FILE
+}
+
+// handleHealth is the liveness check: the process is up.
+func (d *daemon) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady checks that Postgres and Elasticsearch answer.
+func (d *daemon) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := dbpm.PingContext(ctx); err != nil {
+		http.Error(w, "postgres: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := elasticClient.ClusterHealth().Do(ctx); err != nil {
+		http.Error(w, "elasticsearch: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// handleStatus serves the schedule, next and last run of every job.
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := []JobStatus{}
+	for _, job := range d.order {
+		st := *d.jobs[job]
+		st.Next = d.cron.Entry(st.entry).Next
+		list = append(list, st)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"started": d.started,
+		"jobs":    list,
+	})
+}
+
+// handleHistory serves the most recent runs, newest first.
+func (d *daemon) handleHistory(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]RunRecord, 0, len(d.history))
+	for i := len(d.history) - 1; i >= 0; i-- {
+		list = append(list, d.history[i])
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DataSource is one database in config:
+//
+//	[Prod.DataSources.pm]
+//	driver = "postgres"
+//	host = "10.0.0.5"
+//	port = 5432
+//	user = "indexer"
+//	password = "..."
+//	dbname = "pm"
+//	sslmode = "verify-full"
+//	sslrootcert = "/etc/ssl/pg-ca.pem"
+//	maxopenconns = 30
+//
+// The pm, fm and news sources fall back to the Pghost, Fmhost and Myhost settings.
+type DataSource struct {
+	Driver   string // postgres or mysql
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DBName   string
+
+	// SSLMode is disable, require, verify-ca or verify-full for both drivers.
+	// SSLRootCert is the CA bundle; SSLCert and SSLKey a client certificate.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// TimeZone is the zone MySQL DATETIME columns are read in
+	TimeZone string
+
+	MaxOpenConns    int // 30 when 0
+	MaxIdleConns    int // 5 when 0
+	ConnMaxLifetime int // seconds, unlimited when 0
+	ConnMaxIdleTime int // seconds, unlimited when 0
+
+	PingRetries int // 5 when 0
+}
+
+var (
+	dbMu      sync.Mutex
+	databases = map[string]*sql.DB{}
+)
+
+// openDB returns the pool for a named data source, opening and pinging it on
+// first use. Pools are shared and stay open until closeDatabases.
+func openDB(name string) (*sql.DB, error) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if db, ok := databases[name]; ok {
+		return db, nil
+	}
+
+	ds, ok := dataSource(name)
+	if !ok {
+		return nil, fmt.Errorf("no data source %q in config", name)
+	}
+
+	dsn, system, err := ds.dsn(name)
+	if err != nil {
+		return nil, fmt.Errorf("data source %s: %s", name, err)
+	}
+
+	db, err := otelsql.Open(ds.Driver, dsn, otelsql.WithAttributes(
+		attribute.String("db.system", system), attribute.String("db.name", ds.DBName)))
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(orDefault(ds.MaxOpenConns, 30))
+	db.SetMaxIdleConns(orDefault(ds.MaxIdleConns, 5))
+	db.SetConnMaxLifetime(time.Duration(ds.ConnMaxLifetime) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(ds.ConnMaxIdleTime) * time.Second)
+
+	if err := pingDB(db, name, orDefault(ds.PingRetries, 5)); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	logger.Info("database connected", "source", name, "driver", ds.Driver, "host", ds.Host, "dbname", ds.DBName, "sslmode", ds.SSLMode)
+	databases[name] = db
+	return db, nil
+}
+
+// mustOpenDB is openDB for the startup path, where checkErr is the error handling.
+func mustOpenDB(name string) *sql.DB {
+	db, err := openDB(name)
+	checkErr(err)
+	return db
+}
+
+// closeDatabases closes every pool opened by openDB.
+func closeDatabases() {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	for name, db := range databases {
+		if err := db.Close(); err != nil {
+			logger.Warn("closing database failed", "source", name, "err", err)
+		}
+		delete(databases, name)
+	}
+}
+
+// pingDB retries with a doubling delay, so the indexer can start alongside its database.
+func pingDB(db *sql.DB, name string, retries int) error {
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= retries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt < retries {
+			logger.Warn("database not reachable, retrying", "source", name, "attempt", attempt, "err", err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("data source %s: %s", name, err)
+}
+
+// dataSource looks name up in DataSources, then in the older flat settings.
+func dataSource(name string) (DataSource, bool) {
+	if ds, ok := appConfig.DataSources[name]; ok {
+		if ds.Driver == "" {
+			ds.Driver = "postgres"
+		}
+		return ds, true
+	}
+
+	c := appConfig
+	switch name {
+	case "pm":
+		return DataSource{Driver: "postgres", Host: c.Pghost, Port: c.Pgport, User: c.Pguser, Password: c.Pgpassword, DBName: c.Pgdbname}, true
+	case "fm":
+		return DataSource{Driver: "postgres", Host: c.Fmhost, Port: c.Fmport, User: c.Fmuser, Password: c.Fmpassword, DBName: c.Fmdbname}, c.Fmhost != ""
+	case "news":
+		return DataSource{Driver: "mysql", Host: c.Myhost, Port: c.Myport, User: c.Myuser, Password: c.Mypassword, DBName: c.Mydbname}, c.Myhost != ""
+	}
+	return DataSource{}, false
+}
+
+// dsn builds the driver connection string and names the db.system for traces.
+func (ds DataSource) dsn(name string) (string, string, error) {
+	switch ds.Driver {
+	case "postgres":
+		return ds.postgresDSN(), "postgresql", nil
+	case "mysql":
+		dsn, err := ds.mysqlDSN(name)
+		return dsn, "mysql", err
+	}
+	return "", "", fmt.Errorf("unknown driver %q", ds.Driver)
+}
+
+func (ds DataSource) postgresDSN() string {
+	params := map[string]string{
+		"host":     ds.Host,
+		"port":     fmt.Sprint(orDefault(ds.Port, 5432)),
+		"user":     ds.User,
+		"password": ds.Password,
+		"dbname":   ds.DBName,
+		"sslmode":  ds.SSLMode,
+	}
+	if ds.SSLMode == "" {
+		params["sslmode"] = "disable"
+	}
+	if ds.SSLRootCert != "" {
+		params["sslrootcert"] = ds.SSLRootCert
+	}
+	if ds.SSLCert != "" {
+		params["sslcert"] = ds.SSLCert
+		params["sslkey"] = ds.SSLKey
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		if params[k] == "" {
+			continue
+		}
+		v := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(params[k])
+		parts = append(parts, k+"='"+v+"'")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (ds DataSource) mysqlDSN(name string) (string, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = ds.User
+	cfg.Passwd = ds.Password
+	cfg.Net = "tcp"
+	cfg.Addr = fmt.Sprintf("%s:%d", ds.Host, orDefault(ds.Port, 3306))
+	cfg.DBName = ds.DBName
+	cfg.ParseTime = true
+	cfg.Params = map[string]string{"charset": "utf8"}
+
+	loc := time.UTC
+	tz := ds.TimeZone
+	if tz == "" {
+		tz = appConfig.TimeZone
+	}
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return "", err
+		}
+	}
+	cfg.Loc = loc
+
+	switch ds.SSLMode {
+	case "", "disable":
+	case "require":
+		cfg.TLSConfig = "skip-verify"
+	case "verify-ca", "verify-full":
+		tlsConfig, err := ds.tlsConfig()
+		if err != nil {
+			return "", err
+		}
+		key := "ds-" + url.PathEscape(name)
+		if err := mysql.RegisterTLSConfig(key, tlsConfig); err != nil {
+			return "", err
+		}
+		cfg.TLSConfig = key
+	default:
+		return "", fmt.Errorf("unknown sslmode %q", ds.SSLMode)
+	}
+
+	return cfg.FormatDSN(), nil
+}
+
+// tlsConfig trusts SSLRootCert (the system pool when empty). verify-ca checks
+// the chain but not the host name, like libpq.
+func (ds DataSource) tlsConfig() (*tls.Config, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if ds.SSLRootCert != "" {
+		pem, err := os.ReadFile(ds.SSLRootCert)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + ds.SSLRootCert)
+		}
+	}
+
+	c := &tls.Config{RootCAs: roots, ServerName: ds.Host}
+	if ds.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(ds.SSLCert, ds.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if ds.SSLMode == "verify-ca" {
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(raw))
+			for i, b := range raw {
+				cert, err := x509.ParseCertificate(b)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		}
+	}
+	return c, nil
+}
+
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
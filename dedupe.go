@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/olivere/elastic"
+)
+
+// runDedupe implements "dedupe". Designs, applications and news used to be
+// indexed under ids the cluster generated, and designs and applications on
+// typed clusters under their bare database id; they are keyed by mfsDocID and
+// the news id now, so every run after the upgrade left the old copy next to
+// the new one. It deletes the documents whose _id is not the one the indexer
+// would give them, as long as the document under that id exists; the others
+// are kept until a full run has written their new copy.
+func runDedupe() {
+	ctx, span := tracer.Start(context.Background(), "dedupe")
+	defer span.End()
+
+	for _, index := range []string{"mfs", "news"} {
+		exists, err := elasticClient.IndexExists(index).Do(ctx)
+		checkErr(err)
+		if !exists {
+			continue
+		}
+
+		deleted, failed, kept := removeStrayDocs(ctx, index)
+		logger.Info("stray documents removed", "index", index, "docs", deleted, "failed", failed, "kept_without_copy", kept)
+	}
+}
+
+// removeStrayDocs scrolls index and deletes the documents under a foreign id
+// whose correctly keyed copy exists. kept counts the strays without one.
+func removeStrayDocs(ctx context.Context, index string) (deleted int, failed int, kept int) {
+	scroll := elasticClient.Scroll(index).
+		Size(BULK_SIZE).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("id", "doc_type", "total_count"))
+	defer scroll.Clear(context.Background())
+
+	log := logger.With("index", index)
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return deleted, failed, kept
+		}
+		checkErr(err)
+
+		var strays []*elastic.SearchHit
+		var wanted []string
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			var doc struct {
+				ID         int64  `json:"id"`
+				DocType    string `json:"doc_type"`
+				TotalCount int64  `json:"total_count"`
+			}
+			if json.Unmarshal(*hit.Source, &doc) != nil || doc.ID == 0 {
+				continue
+			}
+
+			if want := indexedDocID(index, doc.DocType, doc.TotalCount, doc.ID); want != "" && hit.Id != want {
+				strays = append(strays, hit)
+				wanted = append(wanted, want)
+			}
+		}
+		if len(strays) == 0 {
+			continue
+		}
+
+		present, err := existingIDs(ctx, index, wanted)
+		checkErr(err)
+
+		var reqs []elastic.BulkableRequest
+		for i, hit := range strays {
+			if !present[wanted[i]] {
+				// the only copy; deleting it would lose the document
+				kept++
+				continue
+			}
+			reqs = append(reqs, elastic.NewBulkDeleteRequest().Index(index).Type(bulkType(hit.Type)).Id(hit.Id))
+		}
+		if len(reqs) == 0 {
+			continue
+		}
+
+		n, f, err := sendBulk(ctx, index, reqs, log)
+		checkErr(err)
+		deleted += n
+		failed += f
+	}
+}
+
+// existingIDs reports which of ids are documents of index.
+func existingIDs(ctx context.Context, index string, ids []string) (map[string]bool, error) {
+	mget := elasticClient.MultiGet()
+	for _, id := range ids {
+		mget.Add(elastic.NewMultiGetItem().
+			Index(index).
+			Type(typeName(importType(index))).
+			Id(id).
+			FetchSource(elastic.NewFetchSourceContext(false)))
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	present := map[string]bool{}
+	for _, doc := range res.Docs {
+		if doc.Found {
+			present[doc.Id] = true
+		}
+	}
+	return present, nil
+}
+
+// indexedDocID is the _id the indexer writes a document of index under;
+// mfs documents written before doc_type existed are told apart by total_count.
+func indexedDocID(index string, docType string, totalCount int64, id int64) string {
+	switch index {
+	case "news":
+		return strconv.FormatInt(id, 10)
+	case "mfs":
+		if docType == "" {
+			for t, n := range docTypeTotalCount {
+				if n == totalCount {
+					docType = t
+				}
+			}
+		}
+		if docType != DOC_TYPE_DESIGN && docType != DOC_TYPE_APPLICATION {
+			return ""
+		}
+		return mfsDocID(docType, id)
+	}
+	return ""
+}
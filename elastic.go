@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// apiKeyTransport sends an Elasticsearch API key with every request.
+type apiKeyTransport struct {
+	key  string
+	next http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "ApiKey "+t.key)
+	return t.next.RoundTrip(req)
+}
+
+// initElastic connects to Elastic (comma separated URLs) or ElasticCloudID.
+// HTTPS trusts ElasticCACert in addition to the system roots; credentials are
+// ElasticUser/ElasticPassword or ElasticAPIKey ("id:key" or its base64 form).
+// The cluster is checked ElasticConnectRetries times (5), ElasticConnectTimeout
+// seconds (10) each; bad credentials or certificates fail on the first try.
+func initElastic() {
+	urls, err := elasticURLs()
+	checkErr(err)
+
+	transport, err := elasticTransport()
+	checkErr(err)
+
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(urls...),
+		elastic.SetSniff(false),
+		// checkElastic below reports why a node is unusable, the client's own check does not
+		elastic.SetHealthcheck(false),
+		elastic.SetHttpClient(tracedHTTPClient(transport)),
+	}
+	if appConfig.ElasticUser != "" {
+		options = append(options, elastic.SetBasicAuth(appConfig.ElasticUser, appConfig.ElasticPassword))
+	}
+
+	elasticClient, err = elastic.NewClient(options...)
+	checkErr(err)
+
+	checkErr(checkElastic(urls))
+
+	esVersion, err = detectVersion(context.Background())
+	checkErr(err)
+	logger.Info("elasticsearch version", "distribution", esVersion.Distribution, "version", esVersion.Number, "typeless", esVersion.typeless())
+}
+
+// clusterVersion is what GET / reports about the cluster.
+type clusterVersion struct {
+	Distribution string // elasticsearch or opensearch
+	Number       string
+	Major        int
+}
+
+// esVersion is detected once in initElastic and picks the request format.
+var esVersion = clusterVersion{Distribution: "elasticsearch", Number: "6.0.0", Major: 6}
+
+func detectVersion(ctx context.Context) (clusterVersion, error) {
+	res, err := elasticClient.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: "/"})
+	if err != nil {
+		return clusterVersion{}, err
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(res.Body, &info); err != nil {
+		return clusterVersion{}, err
+	}
+
+	v := clusterVersion{Distribution: info.Version.Distribution, Number: info.Version.Number}
+	if v.Distribution == "" {
+		v.Distribution = "elasticsearch"
+	}
+	if _, err := fmt.Sscanf(v.Number, "%d.", &v.Major); err != nil {
+		return clusterVersion{}, fmt.Errorf("unknown elasticsearch version %q", v.Number)
+	}
+	return v, nil
+}
+
+// typeless is true from Elasticsearch 7 on, and for every OpenSearch release,
+// where indices have no mapping types.
+func (v clusterVersion) typeless() bool {
+	return v.Distribution == "opensearch" || v.Major >= 7
+}
+
+// typeName is the type for the document APIs: t on typed clusters, _doc on typeless ones.
+func typeName(t string) string {
+	if esVersion.typeless() {
+		return "_doc"
+	}
+	return t
+}
+
+// bulkType is the _type of bulk actions. Typeless clusters reject the field,
+// so it is left empty and omitted.
+func bulkType(t string) string {
+	if esVersion.typeless() {
+		return ""
+	}
+	return t
+}
+
+// mfsDocID keeps designs and applications apart in the shared mfs index, which
+// has a single type on every version. The ids are the same everywhere, so a
+// snapshot restores into any cluster without duplicating documents; "dedupe"
+// removes the plain numeric ids older versions wrote.
+func mfsDocID(kind string, id int64) string {
+	return kind + "-" + strconv.FormatInt(id, 10)
+}
+
+// newSearch starts a search that reads hits.total as a number on every version.
+func newSearch(indices ...string) *elastic.SearchService {
+	search := elasticClient.Search(indices...)
+	if esVersion.typeless() {
+		search.RestTotalHitsAsInt(true)
+	}
+	return search
+}
+
+// newMultiSearch is newSearch for the multi search API.
+func newMultiSearch() *elastic.MultiSearchService {
+	msearch := elasticClient.MultiSearch()
+	if esVersion.typeless() {
+		msearch.RestTotalHitsAsInt(true)
+	}
+	return msearch
+}
+
+func elasticURLs() ([]string, error) {
+	if appConfig.ElasticCloudID != "" {
+		u, err := cloudURL(appConfig.ElasticCloudID)
+		if err != nil {
+			return nil, err
+		}
+		return []string{u}, nil
+	}
+
+	var urls []string
+	for _, u := range strings.Split(appConfig.Elastic, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("no Elastic URL or ElasticCloudID in config")
+	}
+	return urls, nil
+}
+
+// cloudURL decodes an Elastic Cloud id, "name:base64(host$es_uuid$kibana_uuid)".
+func cloudURL(id string) (string, error) {
+	i := strings.LastIndex(id, ":")
+	data, err := base64.StdEncoding.DecodeString(id[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("bad ElasticCloudID: %s", err)
+	}
+
+	parts := strings.Split(string(data), "$")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.New("bad ElasticCloudID: expected host$es_uuid")
+	}
+
+	host, port := parts[0], "443"
+	if j := strings.LastIndex(host, ":"); j >= 0 {
+		host, port = host[:j], host[j+1:]
+	}
+	return fmt.Sprintf("https://%s.%s:%s", parts[1], host, port), nil
+}
+
+func elasticTransport() (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if appConfig.ElasticCACert != "" || appConfig.ElasticInsecureSkipVerify {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if appConfig.ElasticCACert != "" {
+			pem, err := os.ReadFile(appConfig.ElasticCACert)
+			if err != nil {
+				return nil, err
+			}
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", appConfig.ElasticCACert)
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:            roots,
+			InsecureSkipVerify: appConfig.ElasticInsecureSkipVerify,
+		}
+	}
+
+	if appConfig.ElasticAPIKey == "" {
+		return transport, nil
+	}
+	key := appConfig.ElasticAPIKey
+	if strings.Contains(key, ":") {
+		key = base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return &apiKeyTransport{key: key, next: transport}, nil
+}
+
+// checkElastic waits for the cluster to answer. Authentication and TLS errors
+// will not go away by retrying and are returned at once.
+func checkElastic(urls []string) error {
+	retries := orDefault(appConfig.ElasticConnectRetries, 5)
+	timeout := time.Duration(orDefault(appConfig.ElasticConnectTimeout, 10)) * time.Second
+	where := redactURL(strings.Join(urls, ","))
+
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= retries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var health *elastic.ClusterHealthResponse
+		health, err = elasticClient.ClusterHealth().Do(ctx)
+		cancel()
+
+		if err == nil {
+			logger.Info("elasticsearch connected", "url", where, "cluster", health.ClusterName, "status", health.Status, "nodes", health.NumberOfNodes)
+			if health.Status == "red" {
+				logger.Warn("elasticsearch cluster is red")
+			}
+			return nil
+		}
+
+		switch {
+		case elastic.IsStatusCode(err, http.StatusUnauthorized):
+			return fmt.Errorf("elasticsearch at %s rejected the credentials (401), check ElasticUser/ElasticPassword or ElasticAPIKey", where)
+		case elastic.IsStatusCode(err, http.StatusForbidden):
+			return fmt.Errorf("elasticsearch at %s: the user or API key may not read cluster health (403)", where)
+		case isCertError(err):
+			return fmt.Errorf("elasticsearch at %s: TLS certificate not trusted, set ElasticCACert: %s", where, err)
+		}
+
+		if attempt < retries {
+			logger.Warn("elasticsearch not reachable, retrying", "url", where, "attempt", attempt, "err", err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("elasticsearch at %s not reachable after %d attempts: %s", where, retries, err)
+}
+
+func isCertError(err error) bool {
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknown) || errors.As(err, &hostname) || errors.As(err, &invalid) ||
+		strings.Contains(err.Error(), "x509:")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// EXPORT_MAX_SIZE is the default size in MB after which an export file is closed
+const EXPORT_MAX_SIZE = 256
+
+// exportRecord (Models) is one document of a snapshot, in the shape of an
+// Elasticsearch hit. Every document carries its _id, so importing a snapshot
+// twice overwrites instead of duplicating.
+type exportRecord struct {
+	Index  string          `json:"_index"`
+	ID     string          `json:"_id,omitempty"`
+	Source json.RawMessage `json:"_source"`
+}
+
+// parquetRecord is exportRecord as a Parquet row; _source stays a JSON string
+// because the document shapes differ between indices.
+type parquetRecord struct {
+	Index  string `parquet:"name=_index, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ID     string `parquet:"name=_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Source string `parquet:"name=_source, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// docSink receives the documents of a job in place of Elasticsearch. Parts
+// are merged from the product offers and written when the sink is closed.
+type docSink interface {
+	write(index string, id string, doc interface{}) error
+	addPart(part PartContent)
+	close() error
+}
+
+// jobSink is set by the export command. The insert functions hand their
+// documents to it and ensureIndex leaves the cluster alone.
+var jobSink docSink
+
+// exportOptions (Models)
+type exportOptions struct {
+	Job     string
+	Format  string // jsonl or parquet
+	Dir     string
+	MaxSize int64 // bytes per file
+	AfterID int64 // product-incremental starts above this id
+}
+
+// runExport implements "export [-format jsonl|parquet] [-dir DIR] [-max-size MB] [-after-id ID] <job>".
+// It runs the job's read and transform stages and writes the documents to
+// DIR/<job>-00001.jsonl.gz, ... instead of indexing them.
+func runExport(args []string) {
+	opts := parseExportArgs(args)
+
+	run, ok := jobs[opts.Job]
+	if !ok || opts.Job == "product-sharded" {
+		checkErr(fmt.Errorf("cannot export job %q", opts.Job))
+	}
+	checkErr(os.MkdirAll(opts.Dir, 0755))
+
+	sink := newFileSink(opts)
+	jobSink = sink
+	exportAfterID = opts.AfterID
+
+	log := logger.With("job", opts.Job, "format", opts.Format, "dir", opts.Dir)
+	log.Info("export started")
+
+	ctx, panics := withPanicCounter(context.Background())
+	ctx, span := tracer.Start(ctx, "export "+opts.Job)
+	run(ctx, log)
+	span.End()
+
+	checkErr(sink.close())
+
+	// the jobs recover their panics; an export that lost documents must not look complete
+	if n := panics.Load(); n > 0 {
+		log.Error("export failed, the files are incomplete", "panics", n, "files", sink.files, "docs", sink.docs)
+		os.Exit(1)
+	}
+	log.Info("export finished", "files", sink.files, "docs", sink.docs)
+}
+
+func parseExportArgs(args []string) exportOptions {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "jsonl (gzip compressed) or parquet")
+	dir := fs.String("dir", "export", "output directory")
+	maxSize := fs.Int64("max-size", EXPORT_MAX_SIZE, "start a new file after this many MB")
+	afterID := fs.Int64("after-id", 0, "product-incremental: export ids above this one")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: gonews_index export [flags] <job>")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	if *format != "jsonl" && *format != "parquet" {
+		checkErr(fmt.Errorf("unknown export format %q", *format))
+	}
+
+	return exportOptions{
+		Job:     fs.Arg(0),
+		Format:  *format,
+		Dir:     *dir,
+		MaxSize: *maxSize << 20,
+		AfterID: *afterID,
+	}
+}
+
+// exportAfterID replaces the highest indexed id for product-incremental exports.
+var exportAfterID int64
+
+// fileSink writes numbered files and starts the next one once MaxSize bytes
+// went to disk. Product workers write concurrently, so it locks.
+type fileSink struct {
+	mu    sync.Mutex
+	opts  exportOptions
+	files int
+	docs  int
+
+	// parts holds the merged part documents of a full product export until
+	// close. Incremental exports see only some offers of a part and leave
+	// parts out, as importing such a part would drop the others.
+	parts map[string]*PartContent
+
+	file    *os.File
+	counter *countingWriter
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	pw      *writer.ParquetWriter
+}
+
+func newFileSink(opts exportOptions) *fileSink {
+	s := &fileSink{opts: opts}
+	if opts.Job == "product" {
+		s.parts = map[string]*PartContent{}
+	}
+	return s
+}
+
+func (s *fileSink) addPart(part PartContent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.parts == nil {
+		return
+	}
+	if p, ok := s.parts[part.ID]; ok {
+		p.addOffer(part)
+		return
+	}
+	s.parts[part.ID] = &part
+}
+
+func (s *fileSink) write(index string, id string, doc interface{}) error {
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.pw != nil {
+		err = s.pw.Write(parquetRecord{Index: index, ID: id, Source: string(source)})
+	} else {
+		err = s.enc.Encode(exportRecord{Index: index, ID: id, Source: source})
+	}
+	if err != nil {
+		return err
+	}
+	s.docs++
+
+	if s.counter.n >= s.opts.MaxSize {
+		return s.closeFile()
+	}
+	return nil
+}
+
+func (s *fileSink) open() error {
+	s.files++
+	ext := ".jsonl.gz"
+	if s.opts.Format == "parquet" {
+		ext = ".parquet"
+	}
+	name := filepath.Join(s.opts.Dir, fmt.Sprintf("%s-%05d%s", s.opts.Job, s.files, ext))
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.counter = &countingWriter{w: f}
+
+	if s.opts.Format == "parquet" {
+		s.pw, err = writer.NewParquetWriterFromWriter(s.counter, new(parquetRecord), 1)
+		if err != nil {
+			return err
+		}
+		s.pw.CompressionType = parquet.CompressionCodec_GZIP
+		// smaller row groups make the file size follow MaxSize more closely
+		s.pw.RowGroupSize = min(s.opts.MaxSize/4, 64<<20)
+		return nil
+	}
+
+	s.gz = gzip.NewWriter(s.counter)
+	s.enc = json.NewEncoder(s.gz)
+	s.enc.SetEscapeHTML(false)
+	return nil
+}
+
+func (s *fileSink) closeFile() error {
+	var err error
+	if s.pw != nil {
+		err = s.pw.WriteStop()
+		s.pw = nil
+	} else {
+		err = s.gz.Close()
+		s.gz, s.enc = nil, nil
+	}
+	err = errors.Join(err, s.file.Sync(), s.file.Close())
+	logger.Debug("export file written", "file", s.file.Name(), "bytes", s.counter.n)
+	s.file = nil
+	return err
+}
+
+func (s *fileSink) close() error {
+	s.mu.Lock()
+	parts := s.parts
+	s.parts = nil
+	s.mu.Unlock()
+
+	ids := make([]string, 0, len(parts))
+	for id := range parts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := s.write("part", id, parts[id]); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.closeFile()
+}
+
+// countingWriter counts the compressed bytes that reached the file.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
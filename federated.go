@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/olivere/elastic"
+)
+
+// Document types; TotalCount carries the same discriminator for documents
+// indexed before doc_type existed.
+const (
+	DOC_TYPE_APPLICATION = "application"
+	DOC_TYPE_DESIGN      = "design"
+	DOC_TYPE_NEWS        = "news"
+	DOC_TYPE_PRODUCT     = "product"
+)
+
+var docTypeTotalCount = map[string]int64{
+	DOC_TYPE_APPLICATION: 1,
+	DOC_TYPE_DESIGN:      2,
+	DOC_TYPE_NEWS:        3,
+}
+
+// FederatedHit (Models)
+type FederatedHit struct {
+	ID        string              `json:"id"`
+	Score     float64             `json:"score"`
+	Source    json.RawMessage     `json:"source"`
+	Highlight map[string][]string `json:"highlight,omitempty"`
+}
+
+// FederatedGroup (Models)
+type FederatedGroup struct {
+	Type  string         `json:"type"`
+	Total int64          `json:"total"`
+	Hits  []FederatedHit `json:"hits"`
+	Error string         `json:"error,omitempty"`
+}
+
+// FederatedResult (Models)
+type FederatedResult struct {
+	Groups []FederatedGroup `json:"groups"`
+}
+
+var designSearchFields = []string{"name^3", "name_norm^3", "pn^2", "mfs", "mfs_canonical", "category", "desc", "desc_norm", "features", "features_norm", "product"}
+
+// handleFederatedSearch serves /search?q=usb&size=5 with the top hits for
+// products, designs, applications and news from one multi-search request.
+func handleFederatedSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	size, err := intParam(q.Get("size"), 5)
+	if err != nil {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+
+	result, err := searchFederated(r.Context(), q.Get("q"), size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+func searchFederated(ctx context.Context, text string, size int) (*FederatedResult, error) {
+	types := []string{DOC_TYPE_PRODUCT, DOC_TYPE_DESIGN, DOC_TYPE_APPLICATION, DOC_TYPE_NEWS}
+
+	msearch := newMultiSearch()
+	for _, t := range types {
+		msearch.Add(federatedRequest(t, text, size))
+	}
+
+	res, err := msearch.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Responses) != len(types) {
+		return nil, fmt.Errorf("multi search returned %d responses for %d requests", len(res.Responses), len(types))
+	}
+
+	result := &FederatedResult{}
+	for i, t := range types {
+		group := FederatedGroup{Type: t, Hits: []FederatedHit{}}
+
+		sr := res.Responses[i]
+		if sr.Error != nil {
+			// one missing index should not hide the other groups
+			group.Error = sr.Error.Reason
+			result.Groups = append(result.Groups, group)
+			continue
+		}
+
+		group.Total = sr.TotalHits()
+		for _, hit := range sr.Hits.Hits {
+			h := FederatedHit{ID: hit.Id, Highlight: hit.Highlight}
+			if hit.Score != nil {
+				h.Score = *hit.Score
+			}
+			if hit.Source != nil {
+				h.Source = *hit.Source
+			}
+			group.Hits = append(group.Hits, h)
+		}
+		result.Groups = append(result.Groups, group)
+	}
+
+	return result, nil
+}
+
+func federatedRequest(docType string, text string, size int) *elastic.SearchRequest {
+	query := elastic.NewBoolQuery()
+
+	switch docType {
+	case DOC_TYPE_PRODUCT:
+		if text != "" {
+			query.Must(productTextQuery(text))
+		}
+		return elastic.NewSearchRequest().Index("product").Query(query).Size(size)
+
+	case DOC_TYPE_NEWS:
+		if text != "" {
+			query.Must(newsTextQuery(text))
+		}
+		return elastic.NewSearchRequest().Index("news").Query(recencyBoost(query)).Highlight(newsHighlight()).Size(size)
+	}
+
+	if text != "" {
+		textQuery := elastic.NewBoolQuery().
+			Should(elastic.NewMultiMatchQuery(text, designSearchFields...)).
+			MinimumNumberShouldMatch(1)
+		for _, variant := range scriptVariants(text) {
+			textQuery.Should(elastic.NewMultiMatchQuery(variant, designSearchFields...))
+		}
+		query.Must(textQuery)
+	}
+	query.Filter(docTypeQuery(docType))
+	return elastic.NewSearchRequest().Index("mfs").Query(query).Size(size)
+}
+
+// docTypeQuery matches doc_type, falling back to the TotalCount discriminator.
+func docTypeQuery(docType string) elastic.Query {
+	return elastic.NewBoolQuery().
+		Should(elastic.NewTermQuery("doc_type", docType)).
+		Should(elastic.NewTermQuery("total_count", docTypeTotalCount[docType])).
+		MinimumNumberShouldMatch(1)
+}
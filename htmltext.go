@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// SUMMARY_SIZE is the number of characters kept in a news summary
+const SUMMARY_SIZE = 200
+
+// allowedTags survive sanitizing; everything else is unwrapped to its text.
+var allowedTags = map[atom.Atom]bool{
+	atom.P: true, atom.Br: true, atom.Div: true, atom.Span: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Ul: true, atom.Ol: true, atom.Li: true, atom.Blockquote: true, atom.Pre: true,
+	atom.B: true, atom.Strong: true, atom.I: true, atom.Em: true, atom.U: true, atom.Sub: true, atom.Sup: true,
+	atom.Table: true, atom.Thead: true, atom.Tbody: true, atom.Tr: true, atom.Th: true, atom.Td: true,
+	atom.A: true, atom.Img: true, atom.Figure: true, atom.Figcaption: true,
+}
+
+// allowedAttrs lists the attributes kept per tag; style, class and on* handlers are dropped.
+var allowedAttrs = map[atom.Atom]map[string]bool{
+	atom.A:   {"href": true, "title": true},
+	atom.Img: {"src": true, "alt": true, "title": true, "width": true, "height": true},
+	atom.Td:  {"colspan": true, "rowspan": true},
+	atom.Th:  {"colspan": true, "rowspan": true},
+}
+
+// droppedTags are removed together with their content.
+var droppedTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Embed: true,
+	atom.Head: true, atom.Title: true, atom.Template: true,
+}
+
+// embedTags are removed but their content is kept: the fallback of an object,
+// and for an iframe, which the parser reads as raw text, the markup an
+// unclosed iframe swallowed.
+var embedTags = map[atom.Atom]bool{
+	atom.Iframe: true, atom.Object: true,
+}
+
+// blockTags start a new line in the plain text.
+var blockTags = map[atom.Atom]bool{
+	atom.P: true, atom.Br: true, atom.Div: true, atom.Li: true, atom.Tr: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Blockquote: true, atom.Pre: true, atom.Table: true, atom.Figure: true, atom.Figcaption: true,
+}
+
+// ArticleText (Models)
+type ArticleText struct {
+	Text      string
+	Summary   string
+	Picture   string
+	Sanitized string
+}
+
+// cleanArticle strips markup from news_article_content.content. It returns the
+// plain text for full-text search, a short summary, the first image URL and a
+// sanitized copy of the HTML for rendering. The HTML is parsed into a tree the
+// way a browser would, so stray end tags are dropped and open elements closed;
+// the sanitized copy is parsed once more after embeds were unwrapped, which
+// can nest elements that may not nest, e.g. a p in a p.
+func cleanArticle(raw string) ArticleText {
+	doc, err := html.Parse(strings.NewReader(raw))
+	if err != nil {
+		// html.Parse only fails when reading fails, which a string reader does not
+		return ArticleText{}
+	}
+
+	c := articleCleaner{}
+	c.walk(doc)
+	plain := collapseText(c.text.String())
+
+	return ArticleText{
+		Text:      plain,
+		Summary:   summarize(plain, SUMMARY_SIZE),
+		Picture:   c.picture,
+		Sanitized: strings.TrimSpace(renderBalanced(c.sanitized.String())),
+	}
+}
+
+// renderBalanced parses an HTML fragment and serializes the resulting tree.
+func renderBalanced(s string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(s), bodyNode())
+	if err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		if err := html.Render(&buf, n); err != nil {
+			return ""
+		}
+	}
+	return buf.String()
+}
+
+func bodyNode() *html.Node {
+	return &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+}
+
+type articleCleaner struct {
+	text, sanitized bytes.Buffer
+	picture         string
+}
+
+func (c *articleCleaner) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		c.text.WriteString(n.Data)
+		c.sanitized.WriteString(html.EscapeString(n.Data))
+		return
+	case html.DocumentNode:
+		c.walkChildren(n)
+		return
+	case html.ElementNode:
+	default:
+		// comments and doctypes
+		return
+	}
+
+	switch {
+	case droppedTags[n.DataAtom]:
+		return
+	case n.DataAtom == atom.Iframe:
+		c.text.WriteByte('\n')
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.TextNode {
+				continue
+			}
+			nodes, err := html.ParseFragment(strings.NewReader(child.Data), bodyNode())
+			if err != nil {
+				continue
+			}
+			for _, node := range nodes {
+				c.walk(node)
+			}
+		}
+		return
+	case embedTags[n.DataAtom]:
+		c.text.WriteByte('\n')
+		c.walkChildren(n)
+		return
+	}
+
+	if blockTags[n.DataAtom] {
+		c.text.WriteByte('\n')
+	}
+	if n.DataAtom == atom.Img && c.picture == "" {
+		if src := safeURL(nodeAttr(n, "src")); src != "" {
+			c.picture = src
+		}
+	}
+
+	allowed := allowedTags[n.DataAtom]
+	if allowed {
+		writeSanitizedTag(&c.sanitized, n)
+	}
+	c.walkChildren(n)
+	if allowed && n.DataAtom != atom.Img && n.DataAtom != atom.Br {
+		c.sanitized.WriteString("</" + n.DataAtom.String() + ">")
+	}
+
+	switch {
+	case blockTags[n.DataAtom]:
+		c.text.WriteByte('\n')
+	case n.DataAtom == atom.Td, n.DataAtom == atom.Th:
+		c.text.WriteByte(' ')
+	}
+}
+
+func (c *articleCleaner) walkChildren(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.walk(child)
+	}
+}
+
+func writeSanitizedTag(buf *bytes.Buffer, n *html.Node) {
+	buf.WriteString("<" + n.DataAtom.String())
+
+	for _, a := range n.Attr {
+		if a.Namespace != "" || !allowedAttrs[n.DataAtom][a.Key] {
+			continue
+		}
+		val := a.Val
+		if a.Key == "href" || a.Key == "src" {
+			if val = safeURL(val); val == "" {
+				continue
+			}
+		}
+		buf.WriteString(" " + a.Key + `="` + html.EscapeString(val) + `"`)
+	}
+
+	if n.DataAtom == atom.Img || n.DataAtom == atom.Br {
+		buf.WriteString(" />")
+	} else {
+		buf.WriteString(">")
+	}
+}
+
+// safeURL keeps relative URLs and http, https and mailto links. Browsers drop
+// tabs, newlines and other control characters inside a URL, so those are
+// removed before the scheme is read; "jav&#x09;ascript:" is javascript: too.
+func safeURL(u string) string {
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	if u == "" {
+		return ""
+	}
+
+	// a colon before any / ? or # ends a scheme; without one the URL is relative
+	end := strings.IndexAny(u, "/?#")
+	if end < 0 {
+		end = len(u)
+	}
+	colon := strings.Index(u[:end], ":")
+	if colon < 0 {
+		return u
+	}
+
+	switch strings.ToLower(u[:colon]) {
+	case "http", "https", "mailto":
+		return u
+	}
+	return ""
+}
+
+func nodeAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// collapseText folds runs of spaces (including &nbsp; and ideographic spaces)
+// and keeps single line breaks.
+func collapseText(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// summarize cuts the text to at most n characters, preferring a sentence end.
+func summarize(s string, n int) string {
+	s = strings.Replace(s, "\n", " ", -1)
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	runes := []rune(s)[:n]
+	for i := len(runes) - 1; i > n/2; i-- {
+		switch runes[i] {
+		case '。', '！', '？', '.', '!', '?':
+			return string(runes[:i+1])
+		}
+	}
+	return strings.TrimSpace(string(runes)) + "…"
+}
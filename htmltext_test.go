@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://example.com/a.png", "https://example.com/a.png"},
+		{"HTTP://example.com/", "HTTP://example.com/"},
+		{"mailto:news@example.com", "mailto:news@example.com"},
+		{"/images/a.png", "/images/a.png"},
+		{"a.png?x=1:2", "a.png?x=1:2"},
+		{"//cdn.example.com/a.png", "//cdn.example.com/a.png"},
+		{" https://example.com/ ", "https://example.com/"},
+		{"javascript:alert(1)", ""},
+		{"JavaScript:alert(1)", ""},
+		{"jav\tascript:alert(1)", ""},
+		{"java\nscript:alert(1)", ""},
+		{"\x01javascript:alert(1)", ""},
+		{"vbscript:msgbox(1)", ""},
+		{"data:text/html;base64,PHNjcmlwdD4=", ""},
+		{"file:///etc/passwd", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := safeURL(tt.in); got != tt.want {
+			t.Errorf("safeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCleanArticleDropsScriptURLs(t *testing.T) {
+	tests := []string{
+		`<a href="jav&#x09;ascript:alert(1)">x</a>`,
+		`<a href="JaVaScRiPt:alert(1)">x</a>`,
+		`<a href="java&#10;script:alert(1)">x</a>`,
+		`<a href="&#106;avascript:alert(1)">x</a>`,
+		`<img src="  data:image/svg+xml,<svg onload=alert(1)>">`,
+	}
+	for _, raw := range tests {
+		got := cleanArticle(raw).Sanitized
+		lower := strings.ToLower(got)
+		if strings.Contains(lower, "script") || strings.Contains(lower, "data:") {
+			t.Errorf("cleanArticle(%q).Sanitized = %q, still holds the script URL", raw, got)
+		}
+	}
+
+	got := cleanArticle(`<a href="https://example.com/">x</a>`).Sanitized
+	if got != `<a href="https://example.com/">x</a>` {
+		t.Errorf("safe link rewritten to %q", got)
+	}
+}
+
+func TestCleanArticleBalancesMarkup(t *testing.T) {
+	tests := []struct {
+		raw       string
+		sanitized string
+		text      string
+	}{
+		{`<div>a</div></div><p>b`, `<div>a</div><p>b</p>`, "a\nb"},
+		{`<table><tr><td>1<td>2</table>`, `<table><tbody><tr><td>1</td><td>2</td></tr></tbody></table>`, "1 2"},
+		{`<p>before<iframe src="https://ads.example.com/">after <b>bold</b></p>`, `<p>beforeafter <b>bold</b></p><p></p><p></p>`, "before\nafter bold"},
+		{`<p>before<object data="x.swf"><p>fallback</object></p><p>after`, `<p>before</p><p>fallback</p><p></p><p>after</p>`, "before\nfallback\nafter"},
+		{`<p>a<script>alert(1)</script>b</p>`, `<p>ab</p>`, "ab"},
+		{`<p>5 &lt; 6 &amp; 7</p>`, `<p>5 &lt; 6 &amp; 7</p>`, "5 < 6 & 7"},
+		{`<p><img src="a.png" onerror="x"><br>t`, `<p><img src="a.png"/><br/>t</p>`, "t"},
+	}
+	for _, tt := range tests {
+		got := cleanArticle(tt.raw)
+		if got.Sanitized != tt.sanitized {
+			t.Errorf("cleanArticle(%q).Sanitized = %q, want %q", tt.raw, got.Sanitized, tt.sanitized)
+		}
+		if got.Text != tt.text {
+			t.Errorf("cleanArticle(%q).Text = %q, want %q", tt.raw, got.Text, tt.text)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// IMPORT_STATE_FILE records the files an import has finished
+const IMPORT_STATE_FILE = "import_state.jsonl"
+
+// IMPORT_MAX_LINE is the longest document line an import reads, in bytes
+const IMPORT_MAX_LINE = 64 << 20
+
+// ImportRecord (Models) is one finished file in the import state.
+type ImportRecord struct {
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Docs     int       `json:"docs"`
+	Failed   int       `json:"failed"`
+	Finished time.Time `json:"finished"`
+}
+
+// importOptions (Models)
+type importOptions struct {
+	Dir   string
+	Index string // overrides _index of every document when set
+	State string
+}
+
+// indexMappings are created by an import when the target does not exist yet.
+var indexMappings = map[string]string{
+	"product": productMapping,
+	"part":    partMapping,
+	"mfs":     mfsMapping,
+	"news":    newsMapping,
+}
+
+// indexTypes are the mapping types of typed (pre 7) clusters.
+var indexTypes = map[string]string{
+	"product": "fmp",
+	"part":    "part",
+	"mfs":     "mfs",
+	"news":    "news",
+}
+
+// runImport implements "import [-index NAME] [-state FILE] <dir>". It streams
+// every *.jsonl, *.ndjson and *.bulk file in dir (optionally .gz) through the
+// bulk pipeline. JSONL lines are export records ({"_index", "_id", "_source"});
+// bulk files hold action and source line pairs as sent to the _bulk API.
+// A file is recorded in the state file once all its documents are in and
+// skipped when the import is run again, so an interrupted import resumes with
+// the next file. Files with failed documents are not recorded and the import
+// exits non-zero; running it again retries them.
+func runImport(args []string) {
+	opts := parseImportArgs(args)
+
+	files, err := importFiles(opts.Dir)
+	checkErr(err)
+	done := loadImportState(opts.State)
+
+	jobProgress = startProgress(0)
+	defer jobProgress.finish()
+
+	log := logger.With("dir", opts.Dir)
+	log.Info("import started", "files", len(files), "finished_before", len(done))
+
+	ctx, span := tracer.Start(context.Background(), "import")
+	defer span.End()
+
+	created := map[string]bool{}
+	var docs, failed, skipped int
+	for _, name := range files {
+		info, err := os.Stat(name)
+		checkErr(err)
+		if rec, ok := done[name]; ok && rec.Failed == 0 && rec.Size == info.Size() && rec.ModTime.Equal(info.ModTime()) {
+			skipped++
+			continue
+		}
+
+		flog := log.With("file", filepath.Base(name))
+		start := time.Now()
+		n, f, err := importFile(ctx, name, opts, created, flog)
+		if err != nil {
+			markFailed(span, err)
+		}
+		checkErr(err)
+		flog.Info("file imported", "docs", n, "failed", f, "elapsed", time.Since(start).String())
+
+		if f == 0 {
+			saveImportState(opts.State, ImportRecord{File: name, Size: info.Size(), ModTime: info.ModTime(), Docs: n, Finished: time.Now()})
+		}
+		docs += n
+		failed += f
+	}
+
+	log.Info("import finished", "docs", docs, "failed", failed, "files_skipped", skipped)
+	if failed > 0 {
+		checkErr(fmt.Errorf("%d documents failed to import, run the import again to retry their files", failed))
+	}
+}
+
+func parseImportArgs(args []string) importOptions {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	index := fs.String("index", "", "write every document to this index instead of its _index")
+	state := fs.String("state", IMPORT_STATE_FILE, "file recording the finished files")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: gonews_index import [flags] <dir>")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return importOptions{Dir: fs.Arg(0), Index: *index, State: *state}
+}
+
+// importFiles lists the snapshot files in name order, which is export order.
+func importFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		ext := strings.TrimSuffix(e.Name(), ".gz")
+		if e.IsDir() || !(strings.HasSuffix(ext, ".jsonl") || strings.HasSuffix(ext, ".ndjson") || strings.HasSuffix(ext, ".bulk")) {
+			continue
+		}
+		abs, err := filepath.Abs(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, abs)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// importFile sends one file in batches of the throttle's size. Whether it is a
+// bulk file is decided by its first line.
+func importFile(ctx context.Context, name string, opts importOptions, created map[string]bool, log *slog.Logger) (docs int, failed int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 1<<20), IMPORT_MAX_LINE)
+
+	label := opts.Index
+	if label == "" {
+		label = "import"
+	}
+
+	var reqs []elastic.BulkableRequest
+	flush := func() error {
+		if len(reqs) == 0 {
+			return nil
+		}
+		indexed, n, err := sendBulk(ctx, label, reqs, log)
+		docs += indexed
+		failed += n
+		jobProgress.addDocs(len(reqs))
+		reqs = reqs[:0]
+		return err
+	}
+
+	var bulk, first = false, true
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Bytes()
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+		if first {
+			bulk, first = isBulkAction(text), false
+		}
+
+		var req elastic.BulkableRequest
+		if bulk {
+			var action bulkAction
+			if action, err = parseBulkAction(text); err != nil {
+				return docs, failed, fmt.Errorf("%s:%d: %s", name, line, err)
+			}
+			var source json.RawMessage
+			if action.op != "delete" {
+				if !scanner.Scan() {
+					return docs, failed, fmt.Errorf("%s:%d: %s action without a source line", name, line, action.op)
+				}
+				line++
+				source = append(json.RawMessage(nil), scanner.Bytes()...)
+			}
+			req = importRequest(action.op, action.Index, action.ID, source, opts, created)
+		} else {
+			var rec exportRecord
+			if err = json.Unmarshal(text, &rec); err != nil {
+				return docs, failed, fmt.Errorf("%s:%d: %s", name, line, err)
+			}
+			req = importRequest("index", rec.Index, rec.ID, rec.Source, opts, created)
+		}
+		jobProgress.addRows(1)
+
+		reqs = append(reqs, req)
+		if len(reqs) >= jobThrottle.batchSize() {
+			if err = flush(); err != nil {
+				return docs, failed, err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return docs, failed, fmt.Errorf("%s:%d: %s", name, line, err)
+	}
+	return docs, failed, flush()
+}
+
+// bulkAction is the action line of a bulk file, e.g. {"index":{"_index":"news","_id":"1"}}.
+type bulkAction struct {
+	op    string
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+func isBulkAction(line []byte) bool {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(line, &obj) != nil || len(obj) != 1 {
+		return false
+	}
+	for op := range obj {
+		return op == "index" || op == "create" || op == "delete" || op == "update"
+	}
+	return false
+}
+
+func parseBulkAction(line []byte) (bulkAction, error) {
+	var obj map[string]bulkAction
+	if err := json.Unmarshal(line, &obj); err != nil {
+		return bulkAction{}, err
+	}
+	for op, a := range obj {
+		if op == "update" {
+			// partial updates need the documents they update, which a snapshot restore does not have
+			return bulkAction{}, errors.New("update actions cannot be imported")
+		}
+		if op != "index" && op != "create" && op != "delete" {
+			return bulkAction{}, fmt.Errorf("unknown bulk action %q", op)
+		}
+		a.op = op
+		return a, nil
+	}
+	return bulkAction{}, errors.New("empty bulk action")
+}
+
+// importRequest builds the bulk request for one document and creates the
+// target index with the mapping of its source index the first time it is seen.
+func importRequest(op string, index string, id string, source json.RawMessage, opts importOptions, created map[string]bool) elastic.BulkableRequest {
+	target := index
+	if opts.Index != "" {
+		target = opts.Index
+	}
+	if target == "" {
+		checkErr(errors.New("document without _index, use -index"))
+	}
+
+	if !created[target] {
+		if mapping, ok := indexMappings[index]; ok {
+			ensureIndex(target, mapping)
+		}
+		created[target] = true
+	}
+
+	typ := bulkType(importType(index))
+	if op == "delete" {
+		return elastic.NewBulkDeleteRequest().Index(target).Type(typ).Id(id)
+	}
+
+	if id == "" && index == "news" {
+		id = newsSourceID(source)
+	}
+	req := elastic.NewBulkIndexRequest().Index(target).Type(typ).Doc(source)
+	if id != "" {
+		req.Id(id)
+	}
+	if op == "create" {
+		req.OpType("create")
+	}
+	return req
+}
+
+// newsSourceID is the _id of news from snapshots taken before exports carried
+// it, so importing them twice does not duplicate the articles.
+func newsSourceID(source json.RawMessage) string {
+	var doc struct {
+		ID int64 `json:"id"`
+	}
+	if json.Unmarshal(source, &doc) != nil || doc.ID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(doc.ID, 10)
+}
+
+// importType is the mapping type a document had in its source index. Every
+// index has a single type; designs and applications differ in doc_type only.
+func importType(index string) string {
+	if t, ok := indexTypes[index]; ok {
+		return t
+	}
+	return "_doc"
+}
+
+// loadImportState reads the finished files; the last record of a file wins.
+func loadImportState(name string) map[string]ImportRecord {
+	done := map[string]ImportRecord{}
+	f, err := os.Open(name)
+	if err != nil {
+		return done
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec ImportRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		done[rec.File] = rec
+	}
+	return done
+}
+
+func saveImportState(name string, rec ImportRecord) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	checkErr(err)
+	defer f.Close()
+	checkErr(json.NewEncoder(f).Encode(rec))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LINK_BATCH_SIZE is the number of part numbers resolved per query
+const LINK_BATCH_SIZE = 1000
+
+// productRef is an fm_product row a design or application refers to.
+type productRef struct {
+	ID     int64
+	PartID string
+}
+
+// splitProducts splits the product column of the *_product join tables,
+// which sometimes lists several part numbers in one row.
+func splitProducts(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\n' || r == '、' || r == '，'
+	})
+}
+
+// appendProducts adds the part numbers of one joined row, skipping blanks and repeats.
+func appendProducts(list []string, product string) []string {
+	for _, pn := range splitProducts(product) {
+		if pn = strings.TrimSpace(pn); pn != "" && !contains(list, pn) {
+			list = append(list, pn)
+		}
+	}
+	return list
+}
+
+// linkProducts resolves the product strings of designs or applications to
+// normalized part numbers, fm_product ids and part document ids.
+func linkProducts(ctx context.Context, records []DesignContent) {
+	ctx, span := tracer.Start(ctx, "link", trace.WithAttributes(attribute.Int("records", len(records))))
+	defer span.End()
+
+	wanted := map[string]bool{}
+	for i := range records {
+		records[i].ProductPnNorm = nil
+		for _, pn := range records[i].Product {
+			if norm := normPn(pn); norm != "" && !contains(records[i].ProductPnNorm, norm) {
+				records[i].ProductPnNorm = append(records[i].ProductPnNorm, norm)
+				wanted[norm] = true
+			}
+		}
+	}
+
+	pns := make([]string, 0, len(wanted))
+	for pn := range wanted {
+		pns = append(pns, pn)
+	}
+
+	refs := map[string][]productRef{}
+	for start := 0; start < len(pns); start += LINK_BATCH_SIZE {
+		end := start + LINK_BATCH_SIZE
+		if end > len(pns) {
+			end = len(pns)
+		}
+		lookupProducts(ctx, pns[start:end], refs)
+	}
+
+	for i := range records {
+		records[i].ProductIDs = nil
+		records[i].PartIDs = nil
+		for _, pn := range records[i].ProductPnNorm {
+			for _, ref := range refs[pn] {
+				records[i].ProductIDs = append(records[i].ProductIDs, ref.ID)
+				if !contains(records[i].PartIDs, ref.PartID) {
+					records[i].PartIDs = append(records[i].PartIDs, ref.PartID)
+				}
+			}
+		}
+	}
+}
+
+// lookupProducts finds fm_product rows by normalized part number. An expression
+// index keeps this from scanning the table:
+//
+//	CREATE INDEX fm_product_pn_norm ON fm_product (upper(regexp_replace(pn, '[^A-Za-z0-9]', '', 'g')));
+func lookupProducts(ctx context.Context, pns []string, refs map[string][]productRef) {
+	sqlstr := `SELECT id, pn, coalesce(mfs, '') mfs FROM fm_product WHERE upper(regexp_replace(pn, '[^A-Za-z0-9]', '', 'g')) = ANY($1)`
+
+	rows, err := dbpm.QueryContext(ctx, sqlstr, pq.Array(pns))
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var pn, mfs string
+		checkErr(rows.Scan(&id, &pn, &mfs))
+
+		mfsID, _ := mfsAliases.canonical(mfs)
+		norm := normPn(pn)
+		refs[norm] = append(refs[norm], productRef{ID: id, PartID: partID(mfsID, mfs, pn)})
+	}
+	checkErr(rows.Err())
+}
+
+// handleDesignParts serves /design/parts?id=12&type=design, the parts used in a
+// design or application.
+func handleDesignParts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	id, err := strconv.ParseInt(q.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	docType := q.Get("type")
+	if docType == "" {
+		docType = DOC_TYPE_DESIGN
+	}
+	if _, ok := docTypeTotalCount[docType]; !ok || docType == DOC_TYPE_NEWS {
+		http.Error(w, "type must be design or application", http.StatusBadRequest)
+		return
+	}
+
+	result, err := designParts(r.Context(), id, docType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+func designParts(ctx context.Context, id int64, docType string) (*PartResult, error) {
+	designs, err := newSearch().
+		Index("mfs").
+		Query(elastic.NewBoolQuery().
+			Filter(elastic.NewTermQuery("id", id)).
+			Filter(docTypeQuery(docType))).
+		Size(100).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var partIDs []interface{}
+	for _, hit := range designs.Hits.Hits {
+		var d DesignContent
+		if err := json.Unmarshal(*hit.Source, &d); err != nil {
+			return nil, err
+		}
+		for _, p := range d.PartIDs {
+			partIDs = append(partIDs, p)
+		}
+	}
+
+	result := &PartResult{Hits: []PartHit{}}
+	if len(partIDs) == 0 {
+		return result, nil
+	}
+
+	parts, err := newSearch().
+		Index("part").
+		Query(elastic.NewTermsQuery("id", partIDs...)).
+		Size(len(partIDs)).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Took = parts.TookInMillis
+	result.Total = parts.TotalHits()
+	for _, hit := range parts.Hits.Hits {
+		var h PartHit
+		if err := json.Unmarshal(*hit.Source, &h.PartContent); err != nil {
+			return nil, err
+		}
+		result.Hits = append(result.Hits, h)
+	}
+
+	return result, nil
+}
+
+// handlePartDesigns serves /part/designs?pn=LM358&mfs=TI, the designs and
+// applications that use a part. Without mfs every manufacturer's pn matches.
+func handlePartDesigns(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	pn := normPn(q.Get("pn"))
+	if pn == "" {
+		http.Error(w, "missing pn", http.StatusBadRequest)
+		return
+	}
+	size, err := intParam(q.Get("size"), 20)
+	if err != nil {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("product_pn_norm", pn))
+	if mfs := q.Get("mfs"); mfs != "" {
+		mfsID, _ := mfsAliases.canonical(mfs)
+		query.Filter(elastic.NewTermQuery("part_ids", partID(mfsID, mfs, pn)))
+	}
+
+	res, err := newSearch().
+		Index("mfs").
+		Query(query).
+		Size(size).
+		Do(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	group := FederatedGroup{Type: "design", Total: res.TotalHits(), Hits: []FederatedHit{}}
+	for _, hit := range res.Hits.Hits {
+		h := FederatedHit{ID: hit.Id}
+		if hit.Source != nil {
+			h.Source = *hit.Source
+		}
+		group.Hits = append(group.Hits, h)
+	}
+
+	writeJSON(w, group)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
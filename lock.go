@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// LOCK_TABLE holds one lease row per job
+const LOCK_TABLE = "index_job_lock"
+
+// LOCK_POLL is how often a waiting instance retries a held lock
+const LOCK_POLL = 5 * time.Second
+
+var (
+	errLocked = errors.New("job is locked by another instance")
+
+	// errLockUnavailable means the lock table could not be read, e.g. while
+	// Postgres restarts; whether the job runs elsewhere is unknown
+	errLockUnavailable = errors.New("job lock unavailable")
+)
+
+// lease is a job lock held by this process until expires; a heartbeat keeps
+// pushing expires forward while the run is alive.
+type lease struct {
+	job    string
+	owner  string
+	ttl    time.Duration
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// extended is when the last successful acquire or heartbeat was sent; the
+	// lease lasts at least ttl from then
+	extended time.Time
+}
+
+// runLocked runs fn while holding the lease for job. Leases live in Postgres
+// and are compared against the database clock, so hosts need not agree on time.
+// A lease whose holder stopped heart-beating for LockTTL seconds (60 by
+// default) is taken over. When the lease is held elsewhere runLocked returns
+// errLocked, or with LockWait set, polls for up to LockWaitTimeout seconds
+// (forever when 0). Database errors are errLockUnavailable and are waited out
+// the same way. If the lease is lost mid-run, fn's context is cancelled.
+func runLocked(ctx context.Context, log *slog.Logger, job string, fn func(ctx context.Context)) error {
+	if err := ensureLockTable(ctx); err != nil {
+		return fmt.Errorf("%w: %s", errLockUnavailable, err)
+	}
+
+	ttl := 60 * time.Second
+	if appConfig.LockTTL > 0 {
+		ttl = time.Duration(appConfig.LockTTL) * time.Second
+	}
+
+	var deadline time.Time
+	if appConfig.LockWaitTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(appConfig.LockWaitTimeout) * time.Second)
+	}
+
+	l := &lease{job: lockName(job), owner: lockOwner(), ttl: ttl}
+	for {
+		sent := time.Now()
+		holder, expires, ok, err := l.acquire(ctx)
+		if ok {
+			l.extended = sent
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: %s: %s", errLockUnavailable, l.job, err)
+		} else {
+			err = fmt.Errorf("%w: %s holds %s until %s", errLocked, holder, l.job, expires.Format(time.RFC3339))
+		}
+		if !appConfig.LockWait || (!deadline.IsZero() && time.Now().After(deadline)) {
+			return err
+		}
+		log.Info("waiting for lock", "lock", l.job, "reason", err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(LOCK_POLL):
+		}
+	}
+
+	ctx = l.keepAlive(ctx, log)
+	defer l.release(log)
+
+	log.Info("lock acquired", "lock", l.job, "owner", l.owner, "ttl", ttl.String())
+	fn(ctx)
+	return nil
+}
+
+// lockName maps a job to the lock it takes; jobs writing the same index share
+// one, so product, product-incremental and product-sharded exclude each other.
+func lockName(job string) string {
+	name, _, _ := strings.Cut(job, "-")
+	return name
+}
+
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), newRunID())
+}
+
+func ensureLockTable(ctx context.Context) error {
+	_, err := dbpm.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+LOCK_TABLE+` (
+		job          text PRIMARY KEY,
+		owner        text NOT NULL,
+		acquired_at  timestamptz NOT NULL,
+		heartbeat_at timestamptz NOT NULL,
+		expires_at   timestamptz NOT NULL
+	)`)
+	return err
+}
+
+// acquire takes the lease if it is free or expired. Otherwise it reports the
+// holder, or the error that kept it from reading the lease.
+func (l *lease) acquire(ctx context.Context) (holder string, expires time.Time, ok bool, err error) {
+	var owner string
+	err = dbpm.QueryRowContext(ctx, `INSERT INTO `+LOCK_TABLE+` (job, owner, acquired_at, heartbeat_at, expires_at)
+		VALUES ($1, $2, now(), now(), now() + $3 * interval '1 second')
+		ON CONFLICT (job) DO UPDATE SET owner = EXCLUDED.owner, acquired_at = now(), heartbeat_at = now(), expires_at = EXCLUDED.expires_at
+		WHERE `+LOCK_TABLE+`.expires_at < now()
+		RETURNING owner`, l.job, l.owner, l.ttl.Seconds()).Scan(&owner)
+	if err == nil {
+		return owner, time.Time{}, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", time.Time{}, false, err
+	}
+
+	err = dbpm.QueryRowContext(ctx, `SELECT owner, expires_at FROM `+LOCK_TABLE+` WHERE job = $1`, l.job).Scan(&holder, &expires)
+	if err == sql.ErrNoRows {
+		// released between the two statements; the next attempt will get it
+		return "nobody", time.Now(), false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	return holder, expires, false, nil
+}
+
+// keepAlive extends the lease every third of its TTL. The returned context is
+// cancelled when the lease cannot be extended, e.g. after another instance
+// took it over while this one was stalled, or when heartbeats kept failing
+// until the lease may have expired.
+func (l *lease) keepAlive(ctx context.Context, log *slog.Logger) context.Context {
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			expiry := time.NewTimer(time.Until(l.extended.Add(l.ttl)))
+			select {
+			case <-ctx.Done():
+				expiry.Stop()
+				return
+			case <-expiry.C:
+				// another instance may hold the lease by now
+				log.Error("lock not extended within its TTL, stopping run", "lock", l.job, "owner", l.owner, "last_extended", l.extended)
+				l.cancel()
+				return
+			case <-ticker.C:
+				expiry.Stop()
+			}
+
+			sent := time.Now()
+			hbCtx, cancel := context.WithTimeout(ctx, l.ttl/3)
+			res, err := dbpm.ExecContext(hbCtx, `UPDATE `+LOCK_TABLE+` SET heartbeat_at = now(), expires_at = now() + $3 * interval '1 second'
+				WHERE job = $1 AND owner = $2`, l.job, l.owner, l.ttl.Seconds())
+			cancel()
+			if err != nil {
+				// a transient error is retried until the lease runs out
+				log.Warn("lock heartbeat failed", "lock", l.job, "err", err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				log.Error("lock lost, stopping run", "lock", l.job, "owner", l.owner)
+				l.cancel()
+				return
+			}
+			l.extended = sent
+		}
+	}()
+	return ctx
+}
+
+func (l *lease) release(log *slog.Logger) {
+	l.cancel()
+	<-l.done
+
+	_, err := dbpm.Exec(`DELETE FROM `+LOCK_TABLE+` WHERE job = $1 AND owner = $2`, l.job, l.owner)
+	if err != nil {
+		log.Warn("releasing lock failed, it expires on its own", "lock", l.job, "err", err)
+		return
+	}
+	log.Info("lock released", "lock", l.job)
+}
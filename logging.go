@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+)
+
+// logger carries run_id and job; batch code adds index, offset and worker.
+// baseLogger has neither and is what daemon runs derive their logger from.
+var (
+	logger     = slog.Default()
+	baseLogger = slog.Default()
+)
+
+type panicCounterKey struct{}
+
+// withPanicCounter gives a run its own count of recovered panics, so it can
+// tell whether any of its batches failed without seeing other runs' panics.
+func withPanicCounter(ctx context.Context) (context.Context, *atomic.Int64) {
+	n := new(atomic.Int64)
+	return context.WithValue(ctx, panicCounterKey{}, n), n
+}
+
+// initLogger builds the process logger from LogFormat ("text" or "json") and
+// LogLevel ("debug", "info", "warn", "error").
+func initLogger(job string) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(appConfig.LogLevel)); err != nil || appConfig.LogLevel == "" {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.EqualFold(appConfig.LogFormat, "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	baseLogger = slog.New(handler)
+	logger = baseLogger.With("run_id", newRunID(), "job", job)
+	slog.SetDefault(logger)
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// runPanics is the number of panics recovered so far in the run of ctx.
+func runPanics(ctx context.Context) int64 {
+	if n, ok := ctx.Value(panicCounterKey{}).(*atomic.Int64); ok {
+		return n.Load()
+	}
+	return 0
+}
+
+// logPanic records a recovered panic with the stack of the goroutine that
+// raised it and counts it against the run of ctx.
+func logPanic(ctx context.Context, log *slog.Logger, r interface{}) {
+	if n, ok := ctx.Value(panicCounterKey{}).(*atomic.Int64); ok {
+		n.Add(1)
+	}
+	log.Error("panic recovered", "panic", r, "stack", string(debug.Stack()))
+}
+
+// redactedConfig is appConfig with passwords and URL credentials masked, safe to log.
+func redactedConfig(c AppConfig) AppConfig {
+	for _, p := range []*string{&c.Pgpassword, &c.Fmpassword, &c.Mypassword, &c.ElasticPassword, &c.ElasticAPIKey} {
+		if *p != "" {
+			*p = "***"
+		}
+	}
+	c.Elastic = redactURL(c.Elastic)
+
+	sources := map[string]DataSource{}
+	for name, ds := range c.DataSources {
+		if ds.Password != "" {
+			ds.Password = "***"
+		}
+		sources[name] = ds
+	}
+	c.DataSources = sources
+	return c
+}
+
+// redactURL masks the passwords in a comma separated list of URLs. A value that
+// is not a scheme://host URL is masked whole, since its credentials cannot be
+// told apart.
+func redactURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	urls := strings.Split(s, ",")
+	for i, raw := range urls {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		switch {
+		case err != nil || u.Host == "":
+			urls[i] = "***"
+		case u.User != nil:
+			urls[i] = u.Redacted()
+		default:
+			urls[i] = u.String()
+		}
+	}
+	return strings.Join(urls, ",")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"http://localhost:9200", "http://localhost:9200"},
+		{"https://u:secret@a:9200", "https://u:xxxxx@a:9200"},
+		{"https://u:secret@a:9200,https://u:secret@b:9200", "https://u:xxxxx@a:9200,https://u:xxxxx@b:9200"},
+		{"http://a:9200, https://u:secret@b:9200", "http://a:9200,https://u:xxxxx@b:9200"},
+		{"u:secret@a:9200", "***"},
+		{"http://u:secret@a:9200/%zz", "***"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := redactURL(tt.in)
+		if got != tt.want {
+			t.Errorf("redactURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if strings.Contains(got, "secret") {
+			t.Errorf("redactURL(%q) leaks the password: %q", tt.in, got)
+		}
+	}
+}
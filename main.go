@@ -4,18 +4,23 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"reflect"
+	"regexp"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/naoina/toml"
 	"github.com/olivere/elastic"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // AppConfig for connection
@@ -36,6 +41,62 @@ type AppConfig struct {
 	Mypassword string
 	Mydbname   string
 	Elastic    string
+
+	ElasticUser               string
+	ElasticPassword           string
+	ElasticAPIKey             string
+	ElasticCloudID            string
+	ElasticCACert             string
+	ElasticInsecureSkipVerify bool
+	ElasticConnectRetries     int
+	ElasticConnectTimeout     int
+
+	DataSources map[string]DataSource
+
+	RefCurrency string
+	RatesFile   string
+	RatesTable  string
+	Listen      string
+
+	MetricsListen string
+
+	LogFormat string
+	LogLevel  string
+
+	ProgressInterval int
+	ExactCount       bool
+
+	TraceExporter string
+	TraceEndpoint string
+	TraceFile     string
+
+	Schedules      []JobSchedule
+	RunHistoryFile string
+
+	LockTTL         int
+	LockWait        bool
+	LockWaitTimeout int
+
+	ShardSize int
+
+	// ProductUpdatedColumn is the fm_product timestamp product-incremental
+	// picks changed rows by; without it the job only sees new ids
+	ProductUpdatedColumn string
+
+	MaxWorkers         int
+	MinBulkSize        int
+	MaxBulkSize        int
+	TargetBulkLatency  int
+	MaxDocsPerSec      float64
+	MaxDocsPerSecHours string
+
+	MfsAliasFile string
+
+	TimeZone string
+
+	CJKAnalyzer string
+	Segment     bool
+	SegmentDict string
 }
 
 // Config for environment
@@ -61,34 +122,56 @@ type ProductContent struct {
 
 // ProductSearchContent (Models)
 type ProductSearchContent struct {
-	Timestamp    time.Time `json:"@timestamp"`
-	Currency     string    `json:"currency"`
-	OfficalPrice string    `json:"offical_price"`
-	Description  string    `json:"description"`
-	Inventory    int       `json:"inventory"`
-	Catalog      string    `json:"catalog"`
-	Version      string    `json:"@version"`
-	Pn           string    `json:"pn"`
-	Supplier     string    `json:"supplier"`
-	SupplierPn   string    `json:"supplier_pn"`
-	ID           int       `json:"id"`
-	Mfs          string    `json:"mfs"`
-	Param        string    `json:"param"`
+	Timestamp       time.Time     `json:"@timestamp"`
+	Currency        string        `json:"currency"`
+	CurrencyRaw     string        `json:"currency_raw"`
+	OfficalPrice    string        `json:"offical_price"`
+	Price           float64       `json:"price"`
+	PriceRef        float64       `json:"price_ref,omitempty"`
+	RefCurrency     string        `json:"ref_currency,omitempty"`
+	PriceBreaks     []PriceBreak  `json:"price_breaks,omitempty"`
+	Description     string        `json:"description"`
+	DescriptionNorm string        `json:"description_norm,omitempty"`
+	DescriptionSeg  string        `json:"description_seg,omitempty"`
+	Inventory       int           `json:"inventory"`
+	InventoryRaw    string        `json:"inventory_raw"`
+	InventoryExact  bool          `json:"inventory_exact"`
+	Catalog         string        `json:"catalog"`
+	Version         string        `json:"@version"`
+	Pn              string        `json:"pn"`
+	Supplier        string        `json:"supplier"`
+	SupplierPn      string        `json:"supplier_pn"`
+	ID              int           `json:"id"`
+	Mfs             string        `json:"mfs"`
+	MfsID           string        `json:"mfs_id,omitempty"`
+	MfsCanonical    string        `json:"mfs_canonical"`
+	Param           string        `json:"param"`
+	Attrs           []ProductAttr `json:"attrs,omitempty"`
 }
 
 // DesignContent (Models)
 type DesignContent struct {
-	ID         int64  `json:"id"`
-	Name       string `json:"name"`
-	Mfs        string `json:"mfs"`
-	Category   string `json:"category"`
-	Pn         string `json:"pn"`
-	Desc       string `json:"desc"`
-	Feature    string `json:"features"`
-	Logo       string `json:"logo"`
-	URL        string `json:"url"`
-	TotalCount int64  `json:"total_count"`
-	Product    string `json:"product"`
+	ID           int64    `json:"id"`
+	Name         string   `json:"name"`
+	Mfs          string   `json:"mfs"`
+	MfsID        string   `json:"mfs_id,omitempty"`
+	MfsCanonical string   `json:"mfs_canonical"`
+	Category     string   `json:"category"`
+	Pn           string   `json:"pn"`
+	Desc         string   `json:"desc"`
+	Feature      string   `json:"features"`
+	NameNorm     string   `json:"name_norm,omitempty"`
+	DescNorm     string   `json:"desc_norm,omitempty"`
+	FeatureNorm  string   `json:"features_norm,omitempty"`
+	Logo         string   `json:"logo"`
+	URL          string   `json:"url"`
+	TotalCount   int64    `json:"total_count"`
+	DocType      string   `json:"doc_type"`
+	Product      []string `json:"product"`
+
+	ProductPnNorm []string `json:"product_pn_norm,omitempty"`
+	ProductIDs    []int64  `json:"product_ids,omitempty"`
+	PartIDs       []string `json:"part_ids,omitempty"`
 }
 
 // NewsContent (Models)
@@ -99,9 +182,15 @@ type NewsContent struct {
 	Content        string    `json:"content"`
 	ArticleContent string    `json:"article_content"`
 	ArticleWeb     string    `json:"article_web"`
+	Summary        string    `json:"summary"`
+	MainTitleNorm  string    `json:"main_title_norm,omitempty"`
+	MainTitleSeg   string    `json:"main_title_seg,omitempty"`
+	ContentNorm    string    `json:"content_norm,omitempty"`
+	ContentSeg     string    `json:"content_seg,omitempty"`
 	CreateTime     time.Time `json:"create_time"`
 	TimeString     string    `json:"time_string"`
 	TotalCount     int64     `json:"total_count"`
+	DocType        string    `json:"doc_type"`
 }
 
 // ProductSearch (Models)
@@ -191,11 +280,17 @@ var myClient = &http.Client{Timeout: 10 * time.Second}
 
 const LIMIT_SIZE = 10000
 
+// BULK_SIZE is the number of products per bulk request
+const BULK_SIZE = 1000
+
+// NEWS_DATE_FORMAT is the layout of time_string
+const NEWS_DATE_FORMAT = "2006/01/02"
+
 // CONFIG is for file name
 const CONFIG = "config.toml"
 
 type worker struct {
-	Func func()
+	Func func(log *slog.Logger)
 }
 
 func loadAppConfig(config Config, env string) AppConfig {
@@ -203,8 +298,7 @@ func loadAppConfig(config Config, env string) AppConfig {
 	return reflect.Indirect(r).FieldByName(env).Interface().(AppConfig)
 }
 
-func settingConfig() {
-	fmt.Printf("Loading config file: %s\n", CONFIG)
+func settingConfig(job string) {
 	configData, err := ioutil.ReadFile(CONFIG)
 	if err != nil {
 		panic(err)
@@ -221,22 +315,115 @@ func settingConfig() {
 		env = "Dev"
 	}
 	appConfig = loadAppConfig(config, env)
-	fmt.Printf("%#v\n", appConfig)
-	fmt.Printf("Environment set to %s\n", env)
+
+	initLogger(job)
+	logger.Info("config loaded", "file", CONFIG, "env", env, "config", fmt.Sprintf("%+v", redactedConfig(appConfig)))
+}
+
+// loadReferenceData reads the exchange rates, the manufacturer aliases, the news
+// time zone and the segmenter dictionary. The daemon reloads them before every
+// run, so rate updates and "mfs-alias add" apply without a restart.
+func loadReferenceData() {
+	rates = loadRates()
+	newsLocation = loadNewsLocation()
+	mfsAliases = loadMfsAliases(aliasFileName())
+	if appConfig.Segment {
+		wordSegmenter = loadSegmenter(appConfig.SegmentDict)
+	}
 }
 
 func main() {
 	var err error
 
-	settingConfig()
+	cmd := "product"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
 
-	dbpm, err = ConnectPM(appConfig.Pghost, appConfig.Pgport, appConfig.Pguser, appConfig.Pgpassword, appConfig.Pgdbname)
-	checkErr(err)
-	defer ClosePM()
+	settingConfig(cmd)
+	start := time.Now()
 
-	initElastic()
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(context.Background(), logger, r)
+			os.Exit(1)
+		}
+	}()
+
+	// Commands that only touch local files
+	switch cmd {
+	case "mfs-alias":
+		mfsAliasCommand(os.Args[2:])
+		return
+	}
+
+	defer initTracing(cmd)()
+
+	// imports feed snapshot files to the cluster and need no database
+	if cmd == "import" {
+		initElastic()
+		serveMetrics()
+		jobThrottle = newThrottle()
+		go jobThrottle.watchCluster(context.Background())
+		runImport(os.Args[2:])
+		return
+	}
+
+	dbpm = mustOpenDB("pm")
+	defer closeDatabases()
+
+	// exports read and transform only; the cluster may not even exist
+	if cmd != "export" {
+		initElastic()
+	}
+
+	loadReferenceData()
+
+	if cmd != "serve" && cmd != "daemon" {
+		serveMetrics()
+	}
+
+	if cmd != "serve" && cmd != "export" {
+		jobThrottle = newThrottle()
+		go jobThrottle.watchCluster(context.Background())
+	}
+
+	switch cmd {
+	case "serve":
+		serveSearch()
+	case "daemon":
+		runDaemon()
+	case "work":
+		runShardWorker()
+	case "mfs-report":
+		mfsReport()
+	case "dedupe":
+		runDedupe()
+	case "export":
+		runExport(os.Args[2:])
+	default:
+		run, ok := jobs[cmd]
+		if !ok {
+			logger.Error("unknown command", "command", cmd)
+			os.Exit(2)
+		}
 
-	paraIndexProduct()
+		ctx, span := tracer.Start(context.Background(), cmd)
+		ctx, _ = withPanicCounter(ctx)
+		err = runLocked(ctx, logger, cmd, func(ctx context.Context) { run(ctx, logger) })
+		span.End()
+		if errors.Is(err, errLocked) {
+			// another instance is on it; not an error for cron
+			logger.Info("job is running elsewhere, exiting", "reason", err.Error())
+			return
+		}
+		if errors.Is(err, errLockUnavailable) {
+			// the job did not start; cron retries it on the next schedule
+			logger.Error("cannot take the job lock, exiting", "reason", err.Error())
+			os.Exit(1)
+		}
+		checkErr(err)
+	}
 
 	/*
 		var offset = 0
@@ -251,31 +438,72 @@ func main() {
 		}
 	*/
 
-	fmt.Printf("Done! \n")
+	logger.Info("done", "elapsed", time.Since(start).String())
 
-	//indexDesign()
-	//indexApplication()
-	//indexNews()
 	//searchElastic("hello world")
 	//searchProductElastic("")
 }
 
-func paraIndexProduct() {
+// jobs are the indexing runs, started by name on the command line or by the daemon.
+// Each run gets its own logger, carrying the run_id and job.
+var jobs = map[string]func(ctx context.Context, log *slog.Logger){
+	"product": func(ctx context.Context, log *slog.Logger) {
+		ensureIndex("product", productMapping)
+		ensureIndex("part", partMapping)
+		paraIndexProduct(ctx, log)
+	},
+	"product-incremental": func(ctx context.Context, log *slog.Logger) {
+		ensureIndex("product", productMapping)
+		ensureIndex("part", partMapping)
+		indexProductIncremental(ctx, log)
+	},
+	"product-sharded": func(ctx context.Context, log *slog.Logger) {
+		ensureIndex("product", productMapping)
+		ensureIndex("part", partMapping)
+		coordinateShards(ctx, log)
+	},
+	"design": func(ctx context.Context, log *slog.Logger) {
+		ensureIndex("mfs", mfsMapping)
+		indexDesign(ctx, log)
+	},
+	"app": func(ctx context.Context, log *slog.Logger) {
+		ensureIndex("mfs", mfsMapping)
+		indexApplication(ctx, log)
+	},
+	"news": func(ctx context.Context, log *slog.Logger) {
+		ensureIndex("news", newsMapping)
+		indexNews(ctx, log)
+	},
+}
+
+func paraIndexProduct(ctx context.Context, runLog *slog.Logger) {
 
 	var wg sync.WaitGroup
 
 	var offset = 0
 
-	channels := make(chan worker, 10)
+	jobProgress = startProgress(estimateRows(dbpm, "fm_product"))
+	defer jobProgress.finish()
 
-	for i := 0; i < 10; i++ {
+	partRun = newRunID()
+	var failed atomic.Int64
+
+	workers := maxWorkers()
+	channels := make(chan worker, workers)
+	workersTotal.Set(float64(workers))
+
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 
+		log := runLog.With("worker", i)
 		go func() {
 			defer wg.Done()
 			for ch := range channels {
 				//reflect.ValueOf(ch.Func).Call(ch.Args)
-				ch.Func()
+				queueDepth.Set(float64(len(channels)))
+				workersBusy.Inc()
+				ch.Func(log)
+				workersBusy.Dec()
 			}
 		}()
 
@@ -287,8 +515,9 @@ func paraIndexProduct() {
 		off := offset
 		offset += 10000
 		wk := worker{
-			Func: func() {
-				cout := indexProduct(off)
+			Func: func(log *slog.Logger) {
+				cout, n := indexProduct(ctx, off, log)
+				failed.Add(int64(n))
 
 				if cout == 0 {
 					quit = 1
@@ -297,8 +526,9 @@ func paraIndexProduct() {
 			},
 		}
 		channels <- wk
+		queueDepth.Set(float64(len(channels)))
 
-		if quit != 0 {
+		if quit != 0 || ctx.Err() != nil {
 			break
 		}
 
@@ -306,6 +536,11 @@ func paraIndexProduct() {
 	close(channels)
 	wg.Wait()
 
+	// only a complete run knows which offers are gone
+	if jobSink == nil && ctx.Err() == nil && runPanics(ctx) == 0 && failed.Load() == 0 {
+		sweepParts(ctx, partRun, runLog)
+	}
+
 }
 
 func searchProductElastic(qry string) {
@@ -321,7 +556,7 @@ func searchProductElastic(qry string) {
 	generalQ := elastic.NewBoolQuery().Should().
 		Filter(term2Query)
 
-	searchResult, err := elasticClient.Search().
+	searchResult, err := newSearch().
 		Index("product").  // search in index "twitter"
 		Query(generalQ).   // specify the query
 		Sort("id", false). // sort by "user" field, ascending
@@ -375,7 +610,7 @@ func searchProductElastic(qry string) {
 
 	s := `{"match_all":{}}`
 
-	res, err := elasticClient.Search().
+	res, err := newSearch().
 		Index("product").
 		Query(elastic.RawStringQuery(s)).
 		Sort("id", false).
@@ -414,7 +649,7 @@ func searchElastic(qry string) {
 	generalQ := elastic.NewBoolQuery().Should().
 		Filter(term1Query).Filter(term2Query)
 
-	searchResult, err := elasticClient.Search().
+	searchResult, err := newSearch().
 		Index("mfs").      // search in index "twitter"
 		Query(generalQ).   // specify the query
 		Sort("id", false). // sort by "user" field, ascending
@@ -468,7 +703,7 @@ func searchElastic(qry string) {
 
 	s := `{"match_all":{}}`
 
-	res, err := elasticClient.Search().
+	res, err := newSearch().
 		Index("mfs").
 		Query(elastic.RawStringQuery(s)).
 		Sort("id", false).
@@ -507,243 +742,567 @@ func getJson(url string, target interface{}) error {
 	return json.NewDecoder(r.Body).Decode(target)
 }
 
-func initElastic() {
-	var err error
-	for {
-		elasticClient, err = elastic.NewClient(
-			elastic.SetURL(appConfig.Elastic),
-			elastic.SetSniff(false),
-		)
-		if err != nil {
-			log.Println(appConfig.Elastic)
-			log.Println(err)
-			time.Sleep(3 * time.Second)
-		} else {
-			break
+// insertProduct writes docs and the part offers derived from them. It returns
+// the number of bulk items Elasticsearch rejected.
+func insertProduct(ctx context.Context, docs []ProductSearchContent, log *slog.Logger) (failed int) {
+	if jobSink != nil {
+		for _, doc := range docs {
+			checkErr(jobSink.write("product", strconv.Itoa(doc.ID), doc))
+			if part, ok := partFromProduct(doc); ok {
+				jobSink.addPart(part)
+			}
 		}
+		jobProgress.addDocs(len(docs))
+		return 0
 	}
-}
+	ctx, span := tracer.Start(ctx, "es.write", trace.WithAttributes(attribute.Int("docs", len(docs))))
+	defer span.End()
+
+	// the batch size is re-read for every request, the throttle adjusts it as the cluster responds
+	for start := 0; start < len(docs); {
+		end := start + jobThrottle.batchSize()
+		if end > len(docs) {
+			end = len(docs)
+		}
 
-func insertProduct(docs []ProductContent) {
-	ctx := context.Background()
+		var reqs []elastic.BulkableRequest
+		for _, doc := range docs[start:end] {
+			reqs = append(reqs, elastic.NewBulkIndexRequest().
+				Index("product").
+				Type(bulkType("fmp")).
+				Id(strconv.Itoa(doc.ID)).
+				Doc(doc))
+
+			// the raw per-supplier product stays; the part groups offers across suppliers
+			if part, ok := partFromProduct(doc); ok {
+				reqs = append(reqs, partUpdateRequest(part))
+			}
+		}
 
-	for _, doc := range docs {
+		_, n, err := sendBulk(ctx, "product", reqs, log)
+		if err != nil {
+			markFailed(span, err)
+		}
+		checkErr(err)
 
-		_, err := elasticClient.Index().
-			Index("product").
-			Type("fmp").
-			Id(strconv.FormatInt(doc.ID, 10)).
-			BodyJson(doc).
-			Do(ctx)
+		jobProgress.addDocs(end - start)
+		failed += n
+		start = end
+	}
 
+	if err := removeMovedOffers(ctx, docs, log); err != nil {
+		markFailed(span, err)
 		checkErr(err)
 	}
 
+	span.SetAttributes(attribute.Int("failed", failed))
+	return failed
 }
 
-func insertDesign(docs []DesignContent) {
+func insertDesign(ctx context.Context, docs []DesignContent) {
+	if jobSink != nil {
+		for _, doc := range docs {
+			checkErr(jobSink.write("mfs", mfsDocID(DOC_TYPE_DESIGN, doc.ID), doc))
+		}
+		jobProgress.addDocs(len(docs))
+		return
+	}
 
-	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "es.write", trace.WithAttributes(attribute.Int("docs", len(docs))))
+	defer span.End()
 
 	for _, doc := range docs {
 
-		_, err := elasticClient.Index().
+		release, err := jobThrottle.acquire(ctx, 1)
+		if err != nil {
+			markFailed(span, err)
+		}
+		checkErr(err)
+		start := time.Now()
+		_, err = elasticClient.Index().
 			Index("mfs").
-			Type("design").
+			Type(typeName("mfs")).
+			Id(mfsDocID(DOC_TYPE_DESIGN, doc.ID)).
 			BodyJson(doc).
 			Do(ctx)
+		bulkSeconds.WithLabelValues("mfs").Observe(time.Since(start).Seconds())
+		release()
+		jobThrottle.observe(time.Since(start), elastic.IsStatusCode(err, 429))
 
+		if err != nil {
+			docsFailed.WithLabelValues("mfs").Inc()
+			markFailed(span, err)
+		}
 		checkErr(err)
+		docsIndexed.WithLabelValues("mfs").Inc()
+		jobProgress.addDocs(1)
 	}
 
 }
 
-func insertApplication(docs []DesignContent) {
+func insertApplication(ctx context.Context, docs []DesignContent) {
+	if jobSink != nil {
+		for _, doc := range docs {
+			checkErr(jobSink.write("mfs", mfsDocID(DOC_TYPE_APPLICATION, doc.ID), doc))
+		}
+		jobProgress.addDocs(len(docs))
+		return
+	}
 
-	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "es.write", trace.WithAttributes(attribute.Int("docs", len(docs))))
+	defer span.End()
 
 	for _, doc := range docs {
 
-		_, err := elasticClient.Index().
+		release, err := jobThrottle.acquire(ctx, 1)
+		if err != nil {
+			markFailed(span, err)
+		}
+		checkErr(err)
+		start := time.Now()
+		_, err = elasticClient.Index().
 			Index("mfs").
-			Type("app").
+			Type(typeName("mfs")).
+			Id(mfsDocID(DOC_TYPE_APPLICATION, doc.ID)).
 			BodyJson(doc).
 			Do(ctx)
+		bulkSeconds.WithLabelValues("mfs").Observe(time.Since(start).Seconds())
+		release()
+		jobThrottle.observe(time.Since(start), elastic.IsStatusCode(err, 429))
 
+		if err != nil {
+			docsFailed.WithLabelValues("mfs").Inc()
+			markFailed(span, err)
+		}
 		checkErr(err)
+		docsIndexed.WithLabelValues("mfs").Inc()
+		jobProgress.addDocs(1)
 	}
 
 }
 
-func insertNews(docs []NewsContent) {
+func insertNews(ctx context.Context, docs []NewsContent) {
+	if jobSink != nil {
+		for _, doc := range docs {
+			checkErr(jobSink.write("news", strconv.FormatInt(doc.ID, 10), doc))
+		}
+		jobProgress.addDocs(len(docs))
+		return
+	}
 
-	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "es.write", trace.WithAttributes(attribute.Int("docs", len(docs))))
+	defer span.End()
 
 	for _, doc := range docs {
 
-		_, err := elasticClient.Index().
+		release, err := jobThrottle.acquire(ctx, 1)
+		if err != nil {
+			markFailed(span, err)
+		}
+		checkErr(err)
+		start := time.Now()
+		_, err = elasticClient.Index().
 			Index("news").
-			Type("news").
+			Type(typeName("news")).
+			Id(strconv.FormatInt(doc.ID, 10)).
 			BodyJson(doc).
 			Do(ctx)
+		bulkSeconds.WithLabelValues("news").Observe(time.Since(start).Seconds())
+		release()
+		jobThrottle.observe(time.Since(start), elastic.IsStatusCode(err, 429))
 
+		if err != nil {
+			docsFailed.WithLabelValues("news").Inc()
+			markFailed(span, err)
+		}
 		checkErr(err)
+		docsIndexed.WithLabelValues("news").Inc()
+		jobProgress.addDocs(1)
 	}
 
 }
 
-func indexApplication() {
+func indexApplication(ctx context.Context, log *slog.Logger) {
+
+	ctx, span := tracer.Start(ctx, "indexApplication")
+	defer span.End()
 
 	var records = []DesignContent{}
 
+	log = log.With("index", "mfs")
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Println(err)
+			logPanic(ctx, log, err)
+			markFailed(span, err)
 		}
 	}()
 
-	sqlstr := fmt.Sprintf("SELECT spider_mfs_application.id, coalesce(name, '') \"name\", coalesce(spider_mfs_application.mfs, '') mfs, coalesce(category, '') category,  '' product_name, coalesce(spider_mfs_application.\"desc\", '') \"desc\", coalesce(features, '') features, coalesce(product, '') product from spider_mfs_application left join spider_mfs_application_product on spider_mfs_application.id = spider_mfs_application_product.id")
+	sqlstr := fmt.Sprintf("SELECT spider_mfs_application.id, coalesce(name, '') \"name\", coalesce(spider_mfs_application.mfs, '') mfs, coalesce(category, '') category,  '' product_name, coalesce(spider_mfs_application.\"desc\", '') \"desc\", coalesce(features, '') features, coalesce(product, '') product from spider_mfs_application left join spider_mfs_application_product on spider_mfs_application.id = spider_mfs_application_product.id order by spider_mfs_application.id")
 
 	//fmt.Print(sqlstr)
 
-	rows, err := dbpm.Query(sqlstr)
+	jobProgress = startProgress(estimateRows(dbpm, "spider_mfs_application"))
+	defer jobProgress.finish()
+
+	start := time.Now()
+	readCtx, readSpan := tracer.Start(ctx, "db.read")
+	rows, err := dbpm.QueryContext(readCtx, sqlstr)
 	checkErr(err)
 
 	defer rows.Close()
 
 	//time.Sleep(time.Duration(20) * time.Second)
 
+	var read int
 	for rows.Next() {
+		read++
+		jobProgress.addRows(1)
 		var content DesignContent
+		var product string
 
-		err = rows.Scan(&content.ID, &content.Name, &content.Mfs, &content.Category, &content.Pn, &content.Desc, &content.Feature, &content.Product)
+		err = rows.Scan(&content.ID, &content.Name, &content.Mfs, &content.Category, &content.Pn, &content.Desc, &content.Feature, &product)
 		checkErr(err)
+
+		// the join yields one row per product; rows arrive ordered by id
+		if n := len(records); n > 0 && records[n-1].ID == content.ID {
+			records[n-1].Product = appendProducts(records[n-1].Product, product)
+			continue
+		}
+
+		content.Product = appendProducts(nil, product)
+		content.MfsID, content.MfsCanonical = mfsAliases.canonical(content.Mfs)
+		content.NameNorm = scriptVariant(content.Name)
+		content.DescNorm = scriptVariant(content.Desc)
+		content.FeatureNorm = scriptVariant(content.Feature)
 		content.TotalCount = 1
+		content.DocType = DOC_TYPE_APPLICATION
 		records = append(records, content)
 	}
 
-	insertApplication(records)
+	readSpan.SetAttributes(attribute.Int("rows", read))
+	readSpan.End()
+
+	rowsRead.WithLabelValues("spider_mfs_application").Add(float64(read))
+	dbReadSeconds.WithLabelValues("spider_mfs_application").Observe(time.Since(start).Seconds())
+	log.Info("rows read", "rows", read, "docs", len(records), "elapsed", time.Since(start).String())
+
+	linkProducts(ctx, records)
+	insertApplication(ctx, records)
 }
 
-func indexDesign() {
+func indexDesign(ctx context.Context, log *slog.Logger) {
+
+	ctx, span := tracer.Start(ctx, "indexDesign")
+	defer span.End()
 
 	var records = []DesignContent{}
 
+	log = log.With("index", "mfs")
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Println(err)
+			logPanic(ctx, log, err)
+			markFailed(span, err)
 		}
 	}()
 
-	sqlstr := fmt.Sprintf("SELECT spider_mfs_design.id, name, coalesce(spider_mfs_design.mfs, '') mfs, coalesce(category, '') category, coalesce(product_name, '') product_name, coalesce(spider_mfs_design.\"desc\", '') \"desc\", coalesce(features, '') features, coalesce(product, '') product from spider_mfs_design left join spider_mfs_design_product on spider_mfs_design.id = spider_mfs_design_product.id")
+	sqlstr := fmt.Sprintf("SELECT spider_mfs_design.id, name, coalesce(spider_mfs_design.mfs, '') mfs, coalesce(category, '') category, coalesce(product_name, '') product_name, coalesce(spider_mfs_design.\"desc\", '') \"desc\", coalesce(features, '') features, coalesce(product, '') product from spider_mfs_design left join spider_mfs_design_product on spider_mfs_design.id = spider_mfs_design_product.id order by spider_mfs_design.id")
 
 	//fmt.Print(sqlstr)
 
-	rows, err := dbpm.Query(sqlstr)
+	jobProgress = startProgress(estimateRows(dbpm, "spider_mfs_design"))
+	defer jobProgress.finish()
+
+	start := time.Now()
+	readCtx, readSpan := tracer.Start(ctx, "db.read")
+	rows, err := dbpm.QueryContext(readCtx, sqlstr)
 	checkErr(err)
 
 	defer rows.Close()
 
 	//time.Sleep(time.Duration(20) * time.Second)
 
+	var read int
 	for rows.Next() {
+		read++
+		jobProgress.addRows(1)
 		var content DesignContent
+		var product string
 
-		err = rows.Scan(&content.ID, &content.Name, &content.Mfs, &content.Category, &content.Pn, &content.Desc, &content.Feature, &content.Product)
+		err = rows.Scan(&content.ID, &content.Name, &content.Mfs, &content.Category, &content.Pn, &content.Desc, &content.Feature, &product)
 		checkErr(err)
+
+		// the join yields one row per product; rows arrive ordered by id
+		if n := len(records); n > 0 && records[n-1].ID == content.ID {
+			records[n-1].Product = appendProducts(records[n-1].Product, product)
+			continue
+		}
+
+		content.Product = appendProducts(nil, product)
+		content.MfsID, content.MfsCanonical = mfsAliases.canonical(content.Mfs)
+		content.NameNorm = scriptVariant(content.Name)
+		content.DescNorm = scriptVariant(content.Desc)
+		content.FeatureNorm = scriptVariant(content.Feature)
 		content.TotalCount = 2
+		content.DocType = DOC_TYPE_DESIGN
 		records = append(records, content)
 	}
 
-	insertDesign(records)
+	readSpan.SetAttributes(attribute.Int("rows", read))
+	readSpan.End()
+
+	rowsRead.WithLabelValues("spider_mfs_design").Add(float64(read))
+	dbReadSeconds.WithLabelValues("spider_mfs_design").Observe(time.Since(start).Seconds())
+	log.Info("rows read", "rows", read, "docs", len(records), "elapsed", time.Since(start).String())
+
+	linkProducts(ctx, records)
+	insertDesign(ctx, records)
 }
 
-func indexProduct(offset int) int {
+func indexProduct(ctx context.Context, offset int, log *slog.Logger) (count int, failed int) {
+
+	sqlstr := fmt.Sprintf(`SELECT id, pn, supplier_pn, coalesce(mfs, '') mfs, "catalog", description, param, supplier, inventory, currency, offical_price FROM fm_product order by id limit %d offset %d `, LIMIT_SIZE, offset)
+
+	//fmt.Print(sqlstr)
+
+	count, _, failed = indexProductRows(ctx, log.With("offset", offset), sqlstr)
+	return count, failed
+}
+
+// indexProductRows reads one batch of fm_product rows, transforms and writes
+// them. It returns the number of rows, the last id read and the number of
+// documents Elasticsearch rejected.
+func indexProductRows(ctx context.Context, log *slog.Logger, sqlstr string, args ...interface{}) (count int, lastID int64, failed int) {
+
+	ctx, span := tracer.Start(ctx, "indexProduct", trace.WithAttributes(attribute.Int("limit", LIMIT_SIZE)))
+	defer span.End()
 
 	start := time.Now()
 
-	var records = []ProductContent{}
+	var records = []ProductSearchContent{}
 
+	log = log.With("index", "product", "limit", LIMIT_SIZE)
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Println(err)
+			logPanic(ctx, log, err)
+			markFailed(span, err)
 		}
 	}()
 
-	sqlstr := fmt.Sprintf(`SELECT id, pn, supplier_pn, coalesce(mfs, '') mfs, "catalog", description, param, supplier, inventory, currency, offical_price FROM fm_product order by id limit %d offset %d `, LIMIT_SIZE, offset)
-
-	//fmt.Print(sqlstr)
-
-	rows, err := dbpm.Query(sqlstr)
+	readCtx, readSpan := tracer.Start(ctx, "db.read")
+	rows, err := dbpm.QueryContext(readCtx, sqlstr, args...)
 	checkErr(err)
 
 	defer rows.Close()
 
 	//time.Sleep(time.Duration(20) * time.Second)
 
-	var count int
+	var contents []ProductContent
 	for rows.Next() {
 		var content ProductContent
 
 		err = rows.Scan(&content.ID, &content.Pn, &content.SupplierPn, &content.Mfs, &content.Catalog, &content.Description, &content.Param, &content.Supplier, &content.Inventory, &content.Currency, &content.OfficialPrice)
 		checkErr(err)
 
-		records = append(records, content)
+		contents = append(contents, content)
 
 		count++
+		lastID = content.ID
+	}
+	readSpan.SetAttributes(attribute.Int("rows", count))
+	readSpan.End()
+
+	_, transformSpan := tracer.Start(ctx, "transform")
+	for _, content := range contents {
+		records = append(records, transformProduct(content))
 	}
+	transformSpan.End()
 
 	elapsed := time.Since(start)
-	fmt.Printf("read %d tooks: %s \n", offset, elapsed)
+	rowsRead.WithLabelValues("fm_product").Add(float64(count))
+	jobProgress.addRows(count)
+	dbReadSeconds.WithLabelValues("fm_product").Observe(elapsed.Seconds())
+	log.Info("batch read", "rows", count, "elapsed", elapsed.String())
 
 	start = time.Now()
 	// write to elasticsearch
-	insertProduct(records)
+	failed = insertProduct(ctx, records, log)
 	elapsed = time.Since(start)
-	fmt.Printf("write tooks: %s \n", elapsed)
+	log.Info("batch written", "docs", len(records), "failed", failed, "elapsed", elapsed.String())
 
-	return count
+	return count, lastID, failed
 }
 
-func indexNews() {
-	dbmy, err := Connect(appConfig.Myhost, appConfig.Myport, appConfig.Myuser, appConfig.Mypassword, appConfig.Mydbname)
+// indexProductIncremental indexes the fm_product rows added since the last
+// run, i.e. with an id above the highest id in the product index. With
+// ProductUpdatedColumn set it also re-indexes rows changed since the last
+// successful run. Without it price and stock changes of existing rows are not
+// picked up, so schedule a full product run as well.
+func indexProductIncremental(ctx context.Context, log *slog.Logger) {
+	maxID := exportAfterID
+	if jobSink == nil {
+		maxID = maxIndexedProductID(ctx)
+	}
+	log = log.With("after_id", maxID)
+
+	where, args := "id > $1", []interface{}{maxID}
+	column := appConfig.ProductUpdatedColumn
+	var since, started time.Time
+	if column != "" {
+		if !sqlIdentifier.MatchString(column) {
+			checkErr(fmt.Errorf("bad ProductUpdatedColumn %q", column))
+		}
+		// the database clock stamps the rows, so it also stamps the watermark
+		checkErr(dbpm.QueryRowContext(ctx, "SELECT now()").Scan(&started))
+		since = loadWatermark(ctx, "product-incremental")
+		where, args = "(id > $1 OR "+column+" > $2)", append(args, since)
+		log = log.With("updated_since", since)
+	} else {
+		log.Warn("ProductUpdatedColumn not set, changed products are not re-indexed")
+	}
+
+	jobProgress = startProgress(countRows(dbpm, "SELECT count(*) FROM fm_product WHERE "+where, args...))
+	defer jobProgress.finish()
+
+	n := len(args)
+	sqlstr := fmt.Sprintf(`SELECT id, pn, supplier_pn, coalesce(mfs, '') mfs, "catalog", description, param, supplier, inventory, currency, offical_price FROM fm_product WHERE %s AND id > $%d order by id limit $%d`, where, n+1, n+2)
+	var cursor int64 = -1
+	if column == "" {
+		cursor = maxID
+	}
+	var failed int
+	for ctx.Err() == nil {
+		count, last, n := indexProductRows(ctx, log.With("from_id", cursor+1), sqlstr, append(args, cursor, LIMIT_SIZE)...)
+		failed += n
+		if count < LIMIT_SIZE || last <= cursor {
+			break
+		}
+		cursor = last
+	}
+
+	// a failed batch is retried next run by leaving the watermark where it was
+	if column != "" && jobSink == nil && ctx.Err() == nil && runPanics(ctx) == 0 && failed == 0 {
+		saveWatermark(ctx, "product-incremental", started)
+	}
+}
+
+// WATERMARK_TABLE keeps the time up to which a job has indexed changed rows
+const WATERMARK_TABLE = "index_watermark"
+
+var sqlIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+func loadWatermark(ctx context.Context, job string) time.Time {
+	_, err := dbpm.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+WATERMARK_TABLE+` (
+		job        text PRIMARY KEY,
+		indexed_to timestamptz NOT NULL
+	)`)
 	checkErr(err)
-	defer Close()
+
+	var t time.Time
+	err = dbpm.QueryRowContext(ctx, `SELECT indexed_to FROM `+WATERMARK_TABLE+` WHERE job = $1`, job).Scan(&t)
+	if err == sql.ErrNoRows {
+		return time.Unix(0, 0)
+	}
+	checkErr(err)
+	return t
+}
+
+func saveWatermark(ctx context.Context, job string, t time.Time) {
+	_, err := dbpm.ExecContext(ctx, `INSERT INTO `+WATERMARK_TABLE+` (job, indexed_to) VALUES ($1, $2)
+		ON CONFLICT (job) DO UPDATE SET indexed_to = EXCLUDED.indexed_to`, job, t)
+	checkErr(err)
+}
+
+func maxIndexedProductID(ctx context.Context) int64 {
+	res, err := newSearch().
+		Index("product").
+		Size(0).
+		Aggregation("max_id", elastic.NewMaxAggregation().Field("id")).
+		Do(ctx)
+	checkErr(err)
+
+	agg, ok := res.Aggregations.Max("max_id")
+	if !ok || agg.Value == nil {
+		return 0
+	}
+	return int64(*agg.Value)
+}
+
+func indexNews(ctx context.Context, log *slog.Logger) {
+	ctx, span := tracer.Start(ctx, "indexNews")
+	defer span.End()
+
+	loc := newsLocation
+
+	// the news source reads DATETIME columns in TimeZone, the same zone as loc
+	dbmy := mustOpenDB("news")
 
 	var records = []NewsContent{}
 
+	log = log.With("index", "news")
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Println(err)
+			logPanic(ctx, log, err)
+			markFailed(span, err)
 		}
 	}()
 
-	sqlstr := fmt.Sprintf("select news_article.id, '' picture, main_title, content, '' article_content, '' article_web, news_article.create_time, date_format(news_article.create_time, '%Y/%m/%d') time_string from news_article inner join news_article_content on news_article.id = news_article_content.article_id")
+	sqlstr := fmt.Sprintf("select news_article.id, '' picture, main_title, content, '' article_content, '' article_web, news_article.create_time from news_article inner join news_article_content on news_article.id = news_article_content.article_id")
 
 	//fmt.Print(sqlstr)
 
-	rows, err := dbmy.Query(sqlstr)
+	jobProgress = startProgress(countRows(dbmy, "SELECT count(*) FROM news_article"))
+	defer jobProgress.finish()
+
+	start := time.Now()
+	readCtx, readSpan := tracer.Start(ctx, "db.read")
+	rows, err := dbmy.QueryContext(readCtx, sqlstr)
 	checkErr(err)
 
 	defer rows.Close()
 
 	//time.Sleep(time.Duration(20) * time.Second)
 
+	var read int
 	for rows.Next() {
+		read++
+		jobProgress.addRows(1)
 		var content NewsContent
 
-		err = rows.Scan(&content.ID, &content.Picture, &content.MainTitle, &content.Content, &content.ArticleContent, &content.ArticleWeb, &content.CreateTime, &content.TimeString)
+		err = rows.Scan(&content.ID, &content.Picture, &content.MainTitle, &content.Content, &content.ArticleContent, &content.ArticleWeb, &content.CreateTime)
 		checkErr(err)
+
+		// create_time is read in loc, so time_string is that zone's calendar day
+		content.TimeString = content.CreateTime.In(loc).Format(NEWS_DATE_FORMAT)
+
+		article := cleanArticle(content.Content)
+		content.Content = article.Text
+		content.Summary = article.Summary
+		content.ArticleContent = article.Sanitized
+		if content.Picture == "" {
+			content.Picture = article.Picture
+		}
+		content.MainTitleNorm = scriptVariant(content.MainTitle)
+		content.ContentNorm = scriptVariant(content.Content)
+		content.MainTitleSeg = segmentText(normalizeScript(content.MainTitle))
+		content.ContentSeg = segmentText(normalizeScript(content.Content))
+
 		content.TotalCount = 3
+		content.DocType = DOC_TYPE_NEWS
 		records = append(records, content)
 	}
 
-	insertNews(records)
+	readSpan.SetAttributes(attribute.Int("rows", read))
+	readSpan.End()
+
+	rowsRead.WithLabelValues("news_article").Add(float64(read))
+	dbReadSeconds.WithLabelValues("news_article").Observe(time.Since(start).Seconds())
+	log.Info("rows read", "rows", read, "docs", len(records), "elapsed", time.Since(start).String())
+
+	insertNews(ctx, records)
 }
 
 func checkErr(err error) {
 	if err != nil {
-		log.Printf("%s", err)
 		panic(err)
 	}
 }
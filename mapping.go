@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// productMapping keeps the typed inventory and price fields numeric so the
+// search side can run range queries and sorts on them. Param attributes are
+// nested so a name and its value are matched together.
+const productMapping = `{
+	"settings": {
+		"analysis": {
+			"normalizer": {
+				"lowercase": { "type": "custom", "filter": ["lowercase"] }
+			}
+		}
+	},
+	"mappings": {
+		"fmp": {
+			"properties": {
+				"id":              { "type": "long" },
+				"pn":              { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+				"supplier_pn":     { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+				"mfs":             { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+				"mfs_id":          { "type": "keyword" },
+				"mfs_canonical":   { "type": "keyword" },
+				"supplier":        { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+				"catalog":         { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+				"description":     { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"description_norm": { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"description_seg": { "type": "text", "analyzer": "whitespace" },
+				"param":           { "type": "text" },
+				"inventory":       { "type": "integer" },
+				"inventory_raw":   { "type": "keyword", "index": false },
+				"inventory_exact": { "type": "boolean" },
+				"currency":        { "type": "keyword" },
+				"currency_raw":    { "type": "keyword", "index": false },
+				"offical_price":   { "type": "keyword", "index": false },
+				"price":           { "type": "scaled_float", "scaling_factor": 10000 },
+				"price_ref":       { "type": "scaled_float", "scaling_factor": 10000 },
+				"ref_currency":    { "type": "keyword" },
+				"price_breaks": {
+					"type": "nested",
+					"properties": {
+						"quantity": { "type": "integer" },
+						"price":    { "type": "scaled_float", "scaling_factor": 10000 }
+					}
+				},
+				"attrs": {
+					"type": "nested",
+					"properties": {
+						"name":  { "type": "keyword" },
+						"value": { "type": "keyword", "normalizer": "lowercase", "ignore_above": 256, "fields": { "text": { "type": "text" } } },
+						"num":   { "type": "double" },
+						"unit":  { "type": "keyword" }
+					}
+				}
+			}
+		}
+	}
+}`
+
+// partMapping holds one document per (mfs, pn) with the supplier offers nested.
+const partMapping = `{
+	"mappings": {
+		"part": {
+			"properties": {
+				"id":             { "type": "keyword" },
+				"pn":             { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+				"pn_norm":        { "type": "keyword" },
+				"mfs_id":         { "type": "keyword" },
+				"mfs_canonical":  { "type": "keyword" },
+				"catalog":        { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+				"description":    { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"description_norm": { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"offer_count":    { "type": "integer" },
+				"total_stock":    { "type": "long" },
+				"best_price_ref": { "type": "scaled_float", "scaling_factor": 10000 },
+				"ref_currency":   { "type": "keyword" },
+				"offers": {
+					"type": "nested",
+					"properties": {
+						"product_id":  { "type": "long" },
+						"supplier":    { "type": "keyword" },
+						"supplier_pn": { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+						"inventory":   { "type": "integer" },
+						"price":       { "type": "scaled_float", "scaling_factor": 10000 },
+						"price_ref":   { "type": "scaled_float", "scaling_factor": 10000 },
+						"currency":    { "type": "keyword" },
+						"run":         { "type": "keyword" }
+					}
+				}
+			}
+		}
+	}
+}`
+
+// mfsMapping holds designs and applications under one type, as Elasticsearch 6
+// allows no more; doc_type tells them apart. product_pn_norm and part_ids link
+// a design to the product and part indices.
+var mfsMapping = `{
+	"mappings": {
+		"mfs": ` + mfsProperties + `
+	}
+}`
+
+const mfsProperties = `{
+	"properties": {
+		"id":              { "type": "long" },
+		"name":            { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+		"name_norm":       { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+		"mfs":             { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+		"mfs_id":          { "type": "keyword" },
+		"mfs_canonical":   { "type": "keyword" },
+		"category":        { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+		"pn":              { "type": "text", "fields": { "keyword": { "type": "keyword", "ignore_above": 256 } } },
+		"desc":            { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+		"desc_norm":       { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+		"features":        { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+		"features_norm":   { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+		"logo":            { "type": "keyword", "index": false },
+		"url":             { "type": "keyword", "index": false },
+		"total_count":     { "type": "integer" },
+		"doc_type":        { "type": "keyword" },
+		"product":         { "type": "text" },
+		"product_pn_norm": { "type": "keyword" },
+		"product_ids":     { "type": "long" },
+		"part_ids":        { "type": "keyword" }
+	}
+}`
+
+// newsMapping analyzes the Chinese title and body with the best available CJK
+// analyzer. *_norm fields hold the Simplified form when it differs from the
+// original and the *_seg fields hold text segmented by the indexer.
+const newsMapping = `{
+	"mappings": {
+		"news": {
+			"properties": {
+				"id":              { "type": "long" },
+				"picture":         { "type": "keyword", "index": false },
+				"main_title":      { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"main_title_norm": { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"main_title_seg":  { "type": "text", "analyzer": "whitespace" },
+				"content":         { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"content_norm":    { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"content_seg":     { "type": "text", "analyzer": "whitespace" },
+				"summary":         { "type": "text", "analyzer": "$CJK_INDEX", "search_analyzer": "$CJK_SEARCH" },
+				"article_content": { "type": "text", "index": false },
+				"article_web":     { "type": "keyword" },
+				"create_time":     { "type": "date" },
+				"time_string":     { "type": "keyword" },
+				"total_count":     { "type": "integer" },
+				"doc_type":        { "type": "keyword" }
+			}
+		}
+	}
+}`
+
+// ensureIndex creates the index with the given mapping when it does not exist yet.
+// Existing indices are left untouched; changing a field type or analyzer needs a rebuild.
+// The mappings above are written per type and unwrapped for typeless clusters.
+func ensureIndex(name string, mapping string) {
+	if jobSink != nil {
+		return
+	}
+	ctx := context.Background()
+
+	exists, err := elasticClient.IndexExists(name).Do(ctx)
+	checkErr(err)
+
+	if exists {
+		return
+	}
+
+	if strings.Contains(mapping, "$CJK_") {
+		index, search := chooseCJKAnalyzer()
+		logger.Info("chinese analyzers chosen", "index", name, "index_analyzer", index, "search_analyzer", search)
+		mapping = strings.NewReplacer("$CJK_INDEX", index, "$CJK_SEARCH", search).Replace(mapping)
+	}
+
+	if esVersion.typeless() {
+		mapping, err = typelessMapping(mapping)
+		checkErr(err)
+	}
+
+	logger.Info("creating index", "index", name)
+	_, err = elasticClient.CreateIndex(name).BodyString(mapping).Do(ctx)
+	checkErr(err)
+}
+
+// typelessMapping lifts the properties of the index's one mapping type up to "mappings".
+func typelessMapping(mapping string) (string, error) {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+		return "", err
+	}
+
+	var types map[string]json.RawMessage
+	if err := json.Unmarshal(body["mappings"], &types); err != nil {
+		return "", err
+	}
+
+	if len(types) != 1 {
+		return "", fmt.Errorf("mapping has %d types, want one", len(types))
+	}
+	for _, m := range types {
+		body["mappings"] = m
+	}
+
+	out, err := json.Marshal(body)
+	return string(out), err
+}
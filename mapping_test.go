@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMappingsHaveOneType(t *testing.T) {
+	for index, mapping := range indexMappings {
+		var body struct {
+			Mappings map[string]json.RawMessage `json:"mappings"`
+		}
+		if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+			t.Fatalf("%s: %v", index, err)
+		}
+		if len(body.Mappings) != 1 {
+			t.Errorf("%s mapping has %d types, Elasticsearch 6 allows one", index, len(body.Mappings))
+		}
+		if _, err := typelessMapping(mapping); err != nil {
+			t.Errorf("%s: %v", index, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	rowsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "indexer_rows_read_total",
+		Help: "Rows read from the source databases.",
+	}, []string{"source"})
+
+	docsIndexed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "indexer_docs_indexed_total",
+		Help: "Documents accepted by Elasticsearch.",
+	}, []string{"index"})
+
+	docsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "indexer_docs_failed_total",
+		Help: "Documents rejected by Elasticsearch.",
+	}, []string{"index"})
+
+	dbReadSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "indexer_db_read_seconds",
+		Help:    "Time to read one batch of rows, including transformation.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"source"})
+
+	bulkSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "indexer_bulk_request_seconds",
+		Help:    "Latency of bulk and index requests to Elasticsearch.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"index"})
+
+	bulkBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "indexer_bulk_batch_size",
+		Help:    "Actions per bulk request.",
+		Buckets: []float64{1, 10, 50, 100, 250, 500, 1000, 2000, 5000},
+	}, []string{"index"})
+
+	workersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "indexer_workers_busy",
+		Help: "Product workers currently running a batch.",
+	})
+
+	workersTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "indexer_workers",
+		Help: "Size of the product worker pool.",
+	})
+
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "indexer_queue_depth",
+		Help: "Batches waiting for a product worker.",
+	})
+
+	bulkRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "indexer_bulk_rejected_total",
+		Help: "Bulk items rejected with 429 and sent again.",
+	}, []string{"index"})
+
+	throttleConcurrency = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "indexer_throttle_concurrency",
+		Help: "Concurrent bulk requests the throttle currently allows.",
+	})
+
+	throttleBatchSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "indexer_throttle_batch_size",
+		Help: "Documents per bulk request the throttle currently allows.",
+	})
+
+	searchSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "search_request_seconds",
+		Help:    "Search API latency by endpoint and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(rowsRead, docsIndexed, docsFailed, dbReadSeconds,
+		bulkSeconds, bulkBatchSize, workersBusy, workersTotal, queueDepth, searchSeconds,
+		bulkRejected, throttleConcurrency, throttleBatchSize)
+}
+
+// serveMetrics exposes /metrics on MetricsListen while a one-shot command
+// runs. It is off unless configured. serve and daemon always have /metrics on
+// their Listen address and do not use MetricsListen.
+func serveMetrics() {
+	if appConfig.MetricsListen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.Info("metrics listening", "addr", appConfig.MetricsListen)
+	go func() {
+		checkErr(http.ListenAndServe(appConfig.MetricsListen, mux))
+	}()
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument records the latency of a search endpoint.
+func instrument(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		searchSeconds.WithLabelValues(endpoint, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	}
+}
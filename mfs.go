@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/naoina/toml"
+)
+
+// MfsAlias (Models)
+type MfsAlias struct {
+	ID      string
+	Name    string
+	Aliases []string
+}
+
+type mfsAliasFile struct {
+	Mfs []MfsAlias
+}
+
+type mfsDictionary struct {
+	entries []MfsAlias
+	byKey   map[string]int
+}
+
+var (
+	mfsAliases = newMfsDictionary(nil)
+)
+
+// MFS_ALIAS_FILE is the default alias dictionary shipped with the indexer
+const MFS_ALIAS_FILE = "mfs_alias.toml"
+
+const mfsAliasHeader = `# Manufacturer alias dictionary.
+#
+# Every spelling listed under aliases (and the name itself) is folded onto id
+# and name when products, designs and applications are indexed. Matching
+# ignores case, punctuation and company suffixes such as Inc., Corp. and Ltd.
+#
+# Extend it with: gonews_index mfs-alias add <id> <alias> [name]
+# Find candidates with: gonews_index mfs-report
+`
+
+// mfsSuffixes are dropped from the end of a manufacturer name before matching.
+var mfsSuffixes = map[string]bool{
+	"INC": true, "INCORPORATED": true, "CORP": true, "CORPORATION": true,
+	"CO": true, "COMPANY": true, "LTD": true, "LIMITED": true, "LLC": true,
+	"GMBH": true, "AG": true, "SA": true, "NV": true, "BV": true, "PLC": true,
+	"KK": true,
+}
+
+func aliasFileName() string {
+	if appConfig.MfsAliasFile != "" {
+		return appConfig.MfsAliasFile
+	}
+	return MFS_ALIAS_FILE
+}
+
+func loadMfsAliases(name string) *mfsDictionary {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		logger.Warn("no manufacturer alias file, names are indexed as is", "file", name)
+		return newMfsDictionary(nil)
+	}
+	checkErr(err)
+
+	var file mfsAliasFile
+	checkErr(toml.Unmarshal(data, &file))
+
+	logger.Info("manufacturer aliases loaded", "manufacturers", len(file.Mfs), "file", name)
+	return newMfsDictionary(file.Mfs)
+}
+
+func newMfsDictionary(entries []MfsAlias) *mfsDictionary {
+	d := &mfsDictionary{byKey: map[string]int{}}
+	for _, e := range entries {
+		d.add(e)
+	}
+	return d
+}
+
+func (d *mfsDictionary) add(e MfsAlias) {
+	d.entries = append(d.entries, e)
+	i := len(d.entries) - 1
+
+	d.byKey[mfsKey(e.ID)] = i
+	d.byKey[mfsKey(e.Name)] = i
+	for _, a := range e.Aliases {
+		d.byKey[mfsKey(a)] = i
+	}
+}
+
+// canonical returns the dictionary id and name for a manufacturer string.
+// Unknown manufacturers keep their trimmed spelling and an empty id.
+func (d *mfsDictionary) canonical(mfs string) (id string, name string) {
+	if i, ok := d.byKey[mfsKey(mfs)]; ok {
+		return d.entries[i].ID, d.entries[i].Name
+	}
+	return "", strings.TrimSpace(mfs)
+}
+
+func (d *mfsDictionary) known(mfs string) bool {
+	_, ok := d.byKey[mfsKey(mfs)]
+	return ok
+}
+
+// mfsKey upper-cases a manufacturer name, drops punctuation and trailing
+// company suffixes: "Texas Instruments, Inc." and "TEXAS INSTRUMENTS" match.
+func mfsKey(s string) string {
+	words := strings.FieldsFunc(strings.ToUpper(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for len(words) > 1 && mfsSuffixes[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+	if len(words) > 1 && words[0] == "THE" {
+		words = words[1:]
+	}
+	key := strings.Join(words, " ")
+	for _, suffix := range []string{"股份有限公司", "有限公司", "公司"} {
+		if strings.HasSuffix(key, suffix) && key != suffix {
+			return strings.TrimSuffix(key, suffix)
+		}
+	}
+	return key
+}
+
+func saveMfsAliases(name string, d *mfsDictionary) error {
+	var buf bytes.Buffer
+	buf.WriteString(mfsAliasHeader)
+
+	entries := append([]MfsAlias(nil), d.entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	for _, e := range entries {
+		quoted := make([]string, len(e.Aliases))
+		for i, a := range e.Aliases {
+			quoted[i] = fmt.Sprintf("%q", a)
+		}
+		fmt.Fprintf(&buf, "\n[[mfs]]\nid = %q\nname = %q\naliases = [%s]\n", e.ID, e.Name, strings.Join(quoted, ", "))
+	}
+
+	return ioutil.WriteFile(name, buf.Bytes(), 0644)
+}
+
+// mfsAliasCommand implements "mfs-alias add <id> <alias> [name]".
+func mfsAliasCommand(args []string) {
+	if len(args) < 3 || args[0] != "add" {
+		fmt.Println("usage: mfs-alias add <id> <alias> [name]")
+		os.Exit(2)
+	}
+
+	id, alias := strings.ToLower(args[1]), args[2]
+	name := alias
+	if len(args) > 3 {
+		name = args[3]
+	}
+
+	file := aliasFileName()
+	d := loadMfsAliases(file)
+
+	if i, ok := d.byKey[mfsKey(alias)]; ok {
+		if d.entries[i].ID != id {
+			fmt.Printf("%q is already an alias of %s\n", alias, d.entries[i].ID)
+			os.Exit(1)
+		}
+		fmt.Printf("%q is already an alias of %s\n", alias, id)
+		return
+	}
+
+	found := false
+	for i := range d.entries {
+		if d.entries[i].ID == id {
+			d.entries[i].Aliases = append(d.entries[i].Aliases, alias)
+			found = true
+		}
+	}
+
+	if found {
+		d = newMfsDictionary(d.entries)
+	} else {
+		d.add(MfsAlias{ID: id, Name: name, Aliases: []string{alias}})
+	}
+
+	checkErr(saveMfsAliases(file, d))
+	fmt.Printf("Added %q to %s in %s\n", alias, id, file)
+}
+
+// mfsReport prints manufacturer strings that the dictionary does not map,
+// most frequent first, across products, designs and applications.
+func mfsReport() {
+	sqlstr := `SELECT mfs, sum(n) FROM (
+		SELECT coalesce(mfs, '') mfs, count(*) n FROM fm_product GROUP BY mfs
+		UNION ALL SELECT coalesce(mfs, '') mfs, count(*) n FROM spider_mfs_design GROUP BY mfs
+		UNION ALL SELECT coalesce(mfs, '') mfs, count(*) n FROM spider_mfs_application GROUP BY mfs
+	) t GROUP BY mfs`
+
+	rows, err := dbpm.Query(sqlstr)
+	checkErr(err)
+	defer rows.Close()
+
+	type unmapped struct {
+		mfs   string
+		count int64
+	}
+	var list []unmapped
+	var total, missing int64
+
+	for rows.Next() {
+		var u unmapped
+		checkErr(rows.Scan(&u.mfs, &u.count))
+
+		total += u.count
+		if strings.TrimSpace(u.mfs) == "" || mfsAliases.known(u.mfs) {
+			continue
+		}
+		missing += u.count
+		list = append(list, u)
+	}
+	checkErr(rows.Err())
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].count != list[j].count {
+			return list[i].count > list[j].count
+		}
+		return list[i].mfs < list[j].mfs
+	})
+
+	for _, u := range list {
+		fmt.Printf("%10d  %s\n", u.count, u.mfs)
+	}
+	fmt.Printf("%d unmapped manufacturer strings covering %d of %d rows\n", len(list), missing, total)
+}
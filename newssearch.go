@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// NewsHit (Models)
+type NewsHit struct {
+	ID         int64               `json:"id"`
+	MainTitle  string              `json:"main_title"`
+	Summary    string              `json:"summary"`
+	Picture    string              `json:"picture"`
+	ArticleWeb string              `json:"article_web"`
+	CreateTime time.Time           `json:"create_time"`
+	TimeString string              `json:"time_string"`
+	Score      float64             `json:"score"`
+	Highlight  map[string][]string `json:"highlight,omitempty"`
+}
+
+// NewsResult (Models)
+type NewsResult struct {
+	Took  int64     `json:"took"`
+	Total int64     `json:"total"`
+	Hits  []NewsHit `json:"hits"`
+}
+
+type newsSearchOptions struct {
+	Query    string
+	FromDate time.Time
+	ToDate   time.Time // exclusive
+	Sort     string
+	Location *time.Location
+	From     int
+	Size     int
+}
+
+var newsSearchFields = []string{"main_title^3", "main_title_norm^3", "summary^2", "content", "content_norm"}
+
+// newsLocation is the zone news_article.create_time is stored in. It is passed
+// to the MySQL driver as loc and used for time_string and date filters. It is
+// loaded once at startup, so a bad TimeZone stops the process right away.
+var newsLocation = time.UTC
+
+func loadNewsLocation() *time.Location {
+	if appConfig.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(appConfig.TimeZone)
+	checkErr(err)
+	return loc
+}
+
+// handleNewsSearch serves /search/news?q=5G&from_date=2018-01-01&to_date=2018-09-01&sort=date&tz=Asia/Taipei
+// from_date and to_date are whole days in tz (the configured TimeZone by default), both inclusive.
+func handleNewsSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	opts := newsSearchOptions{
+		Query:    q.Get("q"),
+		Sort:     q.Get("sort"),
+		Location: newsLocation,
+	}
+
+	var err error
+	if tz := q.Get("tz"); tz != "" {
+		if opts.Location, err = time.LoadLocation(tz); err != nil {
+			http.Error(w, "bad tz", http.StatusBadRequest)
+			return
+		}
+	}
+	if opts.FromDate, _, err = dateParam(q.Get("from_date"), opts.Location); err != nil {
+		http.Error(w, "bad from_date", http.StatusBadRequest)
+		return
+	}
+	var wholeDay bool
+	if opts.ToDate, wholeDay, err = dateParam(q.Get("to_date"), opts.Location); err != nil {
+		http.Error(w, "bad to_date", http.StatusBadRequest)
+		return
+	}
+	if wholeDay {
+		opts.ToDate = opts.ToDate.AddDate(0, 0, 1)
+	}
+	if opts.From, err = intParam(q.Get("from"), 0); err != nil {
+		http.Error(w, "bad from", http.StatusBadRequest)
+		return
+	}
+	if opts.Size, err = intParam(q.Get("size"), 10); err != nil {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+	switch opts.Sort {
+	case "", "relevance", "date":
+	default:
+		http.Error(w, "sort must be relevance or date", http.StatusBadRequest)
+		return
+	}
+
+	result, err := searchNews(r.Context(), opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+func searchNews(ctx context.Context, opts newsSearchOptions) (*NewsResult, error) {
+	query := elastic.NewBoolQuery()
+
+	if opts.Query != "" {
+		query.Must(newsTextQuery(opts.Query))
+	} else {
+		query.Must(elastic.NewMatchAllQuery())
+	}
+
+	if !opts.FromDate.IsZero() || !opts.ToDate.IsZero() {
+		dates := elastic.NewRangeQuery("create_time")
+		if !opts.FromDate.IsZero() {
+			dates.Gte(opts.FromDate.Format(time.RFC3339))
+		}
+		if !opts.ToDate.IsZero() {
+			dates.Lt(opts.ToDate.Format(time.RFC3339))
+		}
+		query.Filter(dates)
+	}
+
+	var scored elastic.Query = query
+	if opts.Sort != "date" {
+		scored = recencyBoost(query)
+	}
+
+	search := newSearch().
+		Index("news").
+		Query(scored).
+		Highlight(newsHighlight()).
+		From(opts.From).Size(opts.Size)
+	if opts.Sort == "date" {
+		search = search.Sort("create_time", false)
+	}
+
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &NewsResult{
+		Took:  searchResult.TookInMillis,
+		Total: searchResult.TotalHits(),
+		Hits:  []NewsHit{},
+	}
+
+	for _, hit := range searchResult.Hits.Hits {
+		var doc NewsContent
+		if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+			return nil, err
+		}
+
+		h := NewsHit{
+			ID:         doc.ID,
+			MainTitle:  doc.MainTitle,
+			Summary:    doc.Summary,
+			Picture:    doc.Picture,
+			ArticleWeb: doc.ArticleWeb,
+			CreateTime: doc.CreateTime.In(opts.Location),
+			TimeString: doc.CreateTime.In(opts.Location).Format(NEWS_DATE_FORMAT),
+			Highlight:  hit.Highlight,
+		}
+		if hit.Score != nil {
+			h.Score = *hit.Score
+		}
+
+		result.Hits = append(result.Hits, h)
+	}
+
+	return result, nil
+}
+
+// newsTextQuery matches the user's text against title, summary and body.
+func newsTextQuery(text string) elastic.Query {
+	query := elastic.NewBoolQuery().
+		Should(elastic.NewMultiMatchQuery(text, newsSearchFields...)).
+		MinimumNumberShouldMatch(1)
+
+	for _, variant := range scriptVariants(text) {
+		query.Should(elastic.NewMultiMatchQuery(variant, newsSearchFields...))
+	}
+	if seg := segmentText(normalizeScript(text)); seg != "" {
+		query.Should(elastic.NewMultiMatchQuery(seg, "main_title_seg^3", "content_seg").Operator("and"))
+	}
+	return query
+}
+
+// recencyBoost keeps most of the score for recent articles; a month old halves it.
+func recencyBoost(query elastic.Query) elastic.Query {
+	return elastic.NewFunctionScoreQuery().
+		Query(query).
+		AddScoreFunc(elastic.NewGaussDecayFunction().
+			FieldName("create_time").
+			Origin("now").
+			Offset("1d").
+			Scale("30d").
+			Decay(0.5)).
+		BoostMode("multiply")
+}
+
+// newsHighlight marks the matches in the title and body. Traditional text found
+// through its Simplified form is highlighted in main_title_norm and content_norm.
+// The fields hold plain text with entities decoded, so the fragments are HTML
+// escaped around the <em> tags.
+func newsHighlight() *elastic.Highlight {
+	return elastic.NewHighlight().
+		Encoder("html").
+		Fields(elastic.NewHighlighterField("main_title").NumOfFragments(0),
+			elastic.NewHighlighterField("main_title_norm").NumOfFragments(0),
+			elastic.NewHighlighterField("content").FragmentSize(120).NumOfFragments(3),
+			elastic.NewHighlighterField("content_norm").FragmentSize(120).NumOfFragments(3)).
+		RequireFieldMatch(false).
+		PreTags("<em>").PostTags("</em>")
+}
+
+// dateParam accepts 2006-01-02 (start of that day in loc, wholeDay is true) or RFC3339.
+func dateParam(s string, loc *time.Location) (t time.Time, wholeDay bool, err error) {
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true, nil
+	}
+	if t, err = time.Parse(time.RFC3339, s); err != nil {
+		return time.Time{}, false, fmt.Errorf("%q is not a date", s)
+	}
+	return t, false, nil
+}
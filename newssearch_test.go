@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewsHighlightEncodesHTML(t *testing.T) {
+	// the indexed content is plain text, markup in the article is literal text there
+	article := cleanArticle("<p>5G &lt;script&gt;alert(1)&lt;/script&gt; modem</p>")
+	if !strings.Contains(article.Text, "<script>") {
+		t.Fatalf("cleanArticle text = %q, want the decoded <script>", article.Text)
+	}
+
+	src, err := newsHighlight().Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"encoder":"html"`) {
+		t.Errorf("highlight %s does not HTML-encode the fragments", body)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/olivere/elastic"
+)
+
+// ProductAttr (Models)
+// Num holds the value in base SI units (F, V, A, Ω, Hz, W, H) when it is numeric.
+type ProductAttr struct {
+	Name  string   `json:"name"`
+	Value string   `json:"value"`
+	Num   *float64 `json:"num,omitempty"`
+	Unit  string   `json:"unit,omitempty"`
+}
+
+type attrFilter struct {
+	Name  string
+	Value string
+	Min   *float64
+	Max   *float64
+	MinEx bool
+	MaxEx bool
+	Unit  string
+}
+
+// attrNames folds the supplier spellings of common parameters onto one name.
+var attrNames = map[string]string{
+	"capacitance":         "capacitance",
+	"cap":                 "capacitance",
+	"voltage_rated":       "voltage",
+	"rated_voltage":       "voltage",
+	"voltage":             "voltage",
+	"voltage_supply":      "supply_voltage",
+	"supply_voltage":      "supply_voltage",
+	"resistance":          "resistance",
+	"inductance":          "inductance",
+	"current_rating":      "current",
+	"current":             "current",
+	"frequency":           "frequency",
+	"power":               "power",
+	"power_watts":         "power",
+	"tolerance":           "tolerance",
+	"package_case":        "package",
+	"package":             "package",
+	"case_package":        "package",
+	"supplier_device_pkg": "package",
+	"封裝":                  "package",
+	"封装":                  "package",
+	"電容":                  "capacitance",
+	"电容":                  "capacitance",
+	"電壓":                  "voltage",
+	"电压":                  "voltage",
+}
+
+var siPrefixes = map[string]float64{
+	"p": 1e-12,
+	"n": 1e-9,
+	"u": 1e-6,
+	"µ": 1e-6,
+	"μ": 1e-6,
+	"m": 1e-3,
+	"k": 1e3,
+	"K": 1e3,
+	"M": 1e6,
+	"G": 1e9,
+}
+
+var siUnits = map[string]string{
+	"f":    "F",
+	"v":    "V",
+	"a":    "A",
+	"ω":    "Ω",
+	"ohm":  "Ω",
+	"ohms": "Ω",
+	"hz":   "Hz",
+	"w":    "W",
+	"h":    "H",
+	"%":    "%",
+}
+
+// quantityRegexp reads the number with its separators, "1,000" and "1,5" are
+// told apart by parseNumber.
+var quantityRegexp = regexp.MustCompile(`^([-+]?\d+(?:[.,]\d+)*)\s*([pnuµμmkKMG]?)\s*([FfVvAaΩω]|[Oo]hms?|[Hh]z|[Ww]|H|%)?(?:$|[\s(/,])`)
+
+// parseParam turns the free-form Param column into typed attributes. It accepts
+// "Name: value; Name: value" lists (also split on '|' or newlines) and JSON objects.
+func parseParam(s string) []ProductAttr {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+
+	var pairs [][2]string
+	if strings.HasPrefix(s, "{") {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &obj); err == nil {
+			for k, v := range obj {
+				pairs = append(pairs, [2]string{k, fmt.Sprint(v)})
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+		}
+	}
+	if pairs == nil {
+		for _, seg := range strings.FieldsFunc(s, func(r rune) bool {
+			return r == ';' || r == '|' || r == '\n' || r == '\r' || r == '；'
+		}) {
+			i := strings.IndexAny(seg, ":=：")
+			if i <= 0 {
+				continue
+			}
+			_, size := utf8.DecodeRuneInString(seg[i:])
+			pairs = append(pairs, [2]string{seg[:i], seg[i+size:]})
+		}
+	}
+
+	var attrs []ProductAttr
+	for _, p := range pairs {
+		name := attrName(p[0])
+		value := strings.TrimSpace(p[1])
+		if name == "" || value == "" || value == "-" {
+			continue
+		}
+
+		attr := ProductAttr{Name: name, Value: value}
+		if num, unit, ok := parseQuantity(value); ok {
+			attr.Num = &num
+			attr.Unit = unit
+		}
+		attrs = append(attrs, attr)
+	}
+
+	return attrs
+}
+
+// attrName lowercases a parameter name and joins its words with '_'.
+func attrName(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	name := strings.Join(words, "_")
+	if canonical, ok := attrNames[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// parseQuantity reads "10uF", "2.2 kΩ", "25V", "±5%" or "100" into a base-unit
+// number; a tolerance is stored as its magnitude. Codes with a leading zero
+// such as package "0805" are not treated as numbers, and neither are values
+// followed by a word that is not a known unit, such as "1 farad" or "100 pcs".
+func parseQuantity(s string) (float64, string, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "±") {
+		s = strings.TrimSpace(strings.TrimPrefix(s, "±"))
+	}
+	if len(s) > 1 && s[0] == '0' && s[1] >= '0' && s[1] <= '9' {
+		return 0, "", false
+	}
+
+	loc := quantityRegexp.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return 0, "", false
+	}
+	group := func(i int) string {
+		if loc[2*i] < 0 {
+			return ""
+		}
+		return s[loc[2*i]:loc[2*i+1]]
+	}
+	prefix, unit := group(2), group(3)
+
+	// the match stops before a word it does not know; "1 farad" is not 1
+	if unit == "" {
+		rest := strings.TrimLeft(s[max(loc[3], loc[5]):], " \t")
+		if r, _ := utf8.DecodeRuneInString(rest); unicode.IsLetter(r) {
+			return 0, "", false
+		}
+	}
+
+	num, ok := parseNumber(group(1))
+	if !ok {
+		return 0, "", false
+	}
+
+	// "1m" without a unit is ambiguous; "1 H" is henry, not hecto.
+	if prefix == "m" && unit == "" {
+		return 0, "", false
+	}
+	if prefix != "" {
+		num *= siPrefixes[prefix]
+	}
+	if unit != "" {
+		unit = siUnits[strings.ToLower(unit)]
+	}
+
+	// Round away float noise from the prefix multiplication.
+	num, _ = strconv.ParseFloat(strconv.FormatFloat(num, 'g', 12, 64), 64)
+	if math.IsInf(num, 0) || math.IsNaN(num) {
+		return 0, "", false
+	}
+
+	return num, unit, true
+}
+
+// parseAttrFilter reads a search parameter such as attr.capacitance=10uF..22uF,
+// attr.voltage=>=25V or attr.package=0805.
+func parseAttrFilter(name string, spec string) (attrFilter, error) {
+	f := attrFilter{Name: attrName(name)}
+	spec = strings.TrimSpace(spec)
+
+	bound := func(s string) (*float64, error) {
+		num, unit, ok := parseQuantity(s)
+		if !ok {
+			return nil, fmt.Errorf("attr.%s: %q is not a number", name, s)
+		}
+		if unit != "" {
+			if f.Unit != "" && f.Unit != unit {
+				return nil, fmt.Errorf("attr.%s: mixed units %s and %s", name, f.Unit, unit)
+			}
+			f.Unit = unit
+		}
+		return &num, nil
+	}
+
+	var err error
+	switch {
+	case strings.Contains(spec, ".."):
+		parts := strings.SplitN(spec, "..", 2)
+		if strings.TrimSpace(parts[0]) != "" {
+			if f.Min, err = bound(parts[0]); err != nil {
+				return f, err
+			}
+		}
+		if strings.TrimSpace(parts[1]) != "" {
+			if f.Max, err = bound(parts[1]); err != nil {
+				return f, err
+			}
+		}
+		if f.Min == nil && f.Max == nil {
+			// a bare ".." would match every value
+			return f, fmt.Errorf("attr.%s: %q has no bounds", name, spec)
+		}
+	case strings.HasPrefix(spec, ">="), strings.HasPrefix(spec, "≥"):
+		f.Min, err = bound(strings.TrimLeft(spec, ">=≥"))
+	case strings.HasPrefix(spec, ">"):
+		f.Min, err = bound(spec[1:])
+		f.MinEx = true
+	case strings.HasPrefix(spec, "<="), strings.HasPrefix(spec, "≤"):
+		f.Max, err = bound(strings.TrimLeft(spec, "<=≤"))
+	case strings.HasPrefix(spec, "<"):
+		f.Max, err = bound(spec[1:])
+		f.MaxEx = true
+	default:
+		f.Value = spec
+	}
+
+	return f, err
+}
+
+// query builds the nested filter on the attrs field.
+func (f attrFilter) query() elastic.Query {
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("attrs.name", f.Name))
+
+	if f.Value != "" {
+		// "0805" should also match "0805 (2012 Metric)".
+		q.Filter(elastic.NewBoolQuery().
+			Should(elastic.NewTermQuery("attrs.value", f.Value)).
+			Should(elastic.NewMatchPhraseQuery("attrs.value.text", f.Value)).
+			MinimumNumberShouldMatch(1))
+	} else {
+		r := elastic.NewRangeQuery("attrs.num")
+		if f.Min != nil {
+			if f.MinEx {
+				r.Gt(*f.Min)
+			} else {
+				r.Gte(*f.Min)
+			}
+		}
+		if f.Max != nil {
+			if f.MaxEx {
+				r.Lt(*f.Max)
+			} else {
+				r.Lte(*f.Max)
+			}
+		}
+		q.Filter(r)
+		if f.Unit != "" {
+			q.Filter(elastic.NewTermQuery("attrs.unit", f.Unit))
+		}
+	}
+
+	return elastic.NewNestedQuery("attrs", q)
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		in   string
+		num  float64
+		unit string
+		ok   bool
+	}{
+		{"10uF", 10e-6, "F", true},
+		{"2.2 kΩ", 2200, "Ω", true},
+		{"25V", 25, "V", true},
+		{"25V DC", 25, "V", true},
+		{"1 M ohm", 1e6, "Ω", true},
+		{"100", 100, "", true},
+		{"100 (typ)", 100, "", true},
+		{"±5%", 5, "%", true},
+		{"± 0.1 %", 0.1, "%", true},
+		{"-40", -40, "", true},
+		{"1,000 pF", 1e-9, "F", true},
+		{"1,5V", 1.5, "V", true},
+		{"1,2,3 V", 0, "", false},
+		{"1 H", 1, "H", true},
+		{"0805", 0, "", false},
+		{"1m", 0, "", false},
+		{"1 farad", 0, "", false},
+		{"100 pcs", 0, "", false},
+		{"10 k resistor", 0, "", false},
+		{"SOT-23", 0, "", false},
+		{"", 0, "", false},
+	}
+	for _, tt := range tests {
+		num, unit, ok := parseQuantity(tt.in)
+		if num != tt.num || unit != tt.unit || ok != tt.ok {
+			t.Errorf("parseQuantity(%q) = %v, %q, %v; want %v, %q, %v", tt.in, num, unit, ok, tt.num, tt.unit, tt.ok)
+		}
+	}
+}
+
+func TestParseAttrFilter(t *testing.T) {
+	f, err := parseAttrFilter("capacitance", "10uF..22uF")
+	if err != nil || f.Min == nil || f.Max == nil || *f.Min != 10e-6 || *f.Max != 22e-6 || f.Unit != "F" {
+		t.Errorf("10uF..22uF = %+v, %v", f, err)
+	}
+
+	f, err = parseAttrFilter("voltage", ">25V")
+	if err != nil || f.Min == nil || *f.Min != 25 || !f.MinEx || f.Max != nil {
+		t.Errorf(">25V = %+v, %v", f, err)
+	}
+
+	f, err = parseAttrFilter("voltage", "..50V")
+	if err != nil || f.Min != nil || f.Max == nil || *f.Max != 50 {
+		t.Errorf("..50V = %+v, %v", f, err)
+	}
+
+	f, err = parseAttrFilter("package", "0805")
+	if err != nil || f.Value != "0805" {
+		t.Errorf("0805 = %+v, %v", f, err)
+	}
+
+	for _, spec := range []string{"..", " .. ", "1V..2A", ">=1 farad"} {
+		if _, err := parseAttrFilter("voltage", spec); err == nil {
+			t.Errorf("parseAttrFilter(%q) accepted", spec)
+		}
+	}
+}
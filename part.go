@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/olivere/elastic"
+)
+
+// PartOffer (Models)
+type PartOffer struct {
+	ProductID  int     `json:"product_id"`
+	Supplier   string  `json:"supplier"`
+	SupplierPn string  `json:"supplier_pn"`
+	Inventory  int     `json:"inventory"`
+	Price      float64 `json:"price"`
+	PriceRef   float64 `json:"price_ref,omitempty"`
+	Currency   string  `json:"currency"`
+
+	// Run is the full product run that last wrote the offer; offers a full
+	// run did not see belong to deleted products
+	Run string `json:"run,omitempty"`
+}
+
+// PartContent (Models)
+// One document per normalized (mfs, pn) holding every supplier offer for it.
+type PartContent struct {
+	ID              string      `json:"id"`
+	Pn              string      `json:"pn"`
+	PnNorm          string      `json:"pn_norm"`
+	MfsID           string      `json:"mfs_id,omitempty"`
+	MfsCanonical    string      `json:"mfs_canonical"`
+	Catalog         string      `json:"catalog"`
+	Description     string      `json:"description"`
+	DescriptionNorm string      `json:"description_norm,omitempty"`
+	Offers          []PartOffer `json:"offers"`
+	OfferCount      int         `json:"offer_count"`
+	TotalStock      int         `json:"total_stock"`
+	BestPriceRef    float64     `json:"best_price_ref,omitempty"`
+	RefCurrency     string      `json:"ref_currency,omitempty"`
+}
+
+// PartHit (Models)
+type PartHit struct {
+	PartContent
+	Score           float64 `json:"score"`
+	DisplayCurrency string  `json:"display_currency,omitempty"`
+	DisplayPrice    float64 `json:"display_best_price,omitempty"`
+}
+
+// PartResult (Models)
+type PartResult struct {
+	Took  int64     `json:"took"`
+	Total int64     `json:"total"`
+	Hits  []PartHit `json:"hits"`
+}
+
+// partRun tags the offers written by the running full product run, see sweepParts.
+var partRun string
+
+// partOfferScript replaces the offer coming from the same fm_product row and
+// recomputes the part totals, so re-indexing a product never duplicates it.
+const partOfferScript = `
+def offers = ctx._source.offers;
+if (offers == null) {
+	offers = new ArrayList();
+	ctx._source.offers = offers;
+}
+offers.removeIf(o -> o.product_id == params.offer.product_id);
+offers.add(params.offer);
+` + partTotalsScript
+
+// partMovedScript drops the offers of products that now belong to another
+// part, because their pn or mfs changed. params.parts maps product id to part id.
+const partMovedScript = `
+def offers = ctx._source.offers;
+int before = offers.size();
+offers.removeIf(o -> {
+	def want = params.parts.get(String.valueOf(o.product_id));
+	return want != null && want != ctx._id;
+});
+if (offers.size() == before) {
+	ctx.op = 'noop';
+	return;
+}
+if (offers.isEmpty()) {
+	ctx.op = 'delete';
+	return;
+}
+` + partTotalsScript
+
+// partSweepScript drops the offers a full run did not write, i.e. of products
+// deleted from fm_product.
+const partSweepScript = `
+def offers = ctx._source.offers;
+int before = offers.size();
+offers.removeIf(o -> o.run != params.run);
+if (offers.size() == before) {
+	ctx.op = 'noop';
+	return;
+}
+if (offers.isEmpty()) {
+	ctx.op = 'delete';
+	return;
+}
+` + partTotalsScript
+
+// partTotalsScript recomputes the totals from ctx._source.offers.
+const partTotalsScript = `
+long stock = 0;
+def best = null;
+for (o in offers) {
+	stock += o.inventory;
+	if (o.price_ref != null && o.price_ref > 0 && (best == null || o.price_ref < best)) {
+		best = o.price_ref;
+	}
+}
+ctx._source.offer_count = offers.size();
+ctx._source.total_stock = stock;
+ctx._source.best_price_ref = best;
+if (ctx._source.description == null || ctx._source.description == '') {
+	ctx._source.description = params.description;
+	ctx._source.description_norm = params.description_norm;
+}
+`
+
+// normPn upper-cases a part number and drops separators: "LM358-N" and "lm358n" match.
+func normPn(pn string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, pn)
+}
+
+// partID keys a part by canonical manufacturer and normalized part number.
+func partID(mfsID string, mfs string, pn string) string {
+	if mfsID == "" {
+		mfsID = strings.ToLower(mfsKey(mfs))
+	}
+	return mfsID + "|" + normPn(pn)
+}
+
+func partFromProduct(doc ProductSearchContent) (PartContent, bool) {
+	pnNorm := normPn(doc.Pn)
+	if pnNorm == "" {
+		return PartContent{}, false
+	}
+
+	offer := PartOffer{
+		ProductID:  doc.ID,
+		Supplier:   doc.Supplier,
+		SupplierPn: doc.SupplierPn,
+		Inventory:  doc.Inventory,
+		Price:      doc.Price,
+		PriceRef:   doc.PriceRef,
+		Currency:   doc.Currency,
+		Run:        partRun,
+	}
+
+	return PartContent{
+		ID:              partID(doc.MfsID, doc.Mfs, doc.Pn),
+		Pn:              doc.Pn,
+		PnNorm:          pnNorm,
+		MfsID:           doc.MfsID,
+		MfsCanonical:    doc.MfsCanonical,
+		Catalog:         doc.Catalog,
+		Description:     doc.Description,
+		DescriptionNorm: doc.DescriptionNorm,
+		Offers:          []PartOffer{offer},
+		OfferCount:      1,
+		TotalStock:      offer.Inventory,
+		BestPriceRef:    offer.PriceRef,
+		RefCurrency:     doc.RefCurrency,
+	}, true
+}
+
+// addOffer merges the single offer of part into p the way partOfferScript
+// does in the cluster. Exports build their part documents with it.
+func (p *PartContent) addOffer(part PartContent) {
+	offer := part.Offers[0]
+	offers := make([]PartOffer, 0, len(p.Offers)+1)
+	for _, o := range p.Offers {
+		if o.ProductID != offer.ProductID {
+			offers = append(offers, o)
+		}
+	}
+	p.Offers = append(offers, offer)
+
+	p.OfferCount = len(p.Offers)
+	p.TotalStock = 0
+	p.BestPriceRef = 0
+	for _, o := range p.Offers {
+		p.TotalStock += o.Inventory
+		if o.PriceRef > 0 && (p.BestPriceRef == 0 || o.PriceRef < p.BestPriceRef) {
+			p.BestPriceRef = o.PriceRef
+		}
+	}
+	if p.Description == "" {
+		p.Description, p.DescriptionNorm = part.Description, part.DescriptionNorm
+	}
+}
+
+// MAX_PART_MOVE_ATTEMPTS is how often removeMovedOffers reruns its update while
+// other workers' writes to the same parts conflict with it
+const MAX_PART_MOVE_ATTEMPTS = 5
+
+// removeMovedOffers takes the offers of docs out of the parts they no longer
+// belong to. It runs after the batch's bulk request has added them to their
+// current part. Parts another worker wrote meanwhile are skipped by the
+// update, so it is rerun until none conflict; the script leaves parts it
+// already cleaned unchanged.
+func removeMovedOffers(ctx context.Context, docs []ProductSearchContent, log *slog.Logger) error {
+	parts := map[string]interface{}{}
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		id := ""
+		if p, ok := partFromProduct(doc); ok {
+			id = p.ID
+		}
+		parts[strconv.Itoa(doc.ID)] = id
+		ids = append(ids, doc.ID)
+	}
+
+	delay := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		res, err := elasticClient.UpdateByQuery("part").
+			Query(elastic.NewNestedQuery("offers", elastic.NewTermsQuery("offers.product_id", ids...))).
+			Script(elastic.NewScript(partMovedScript).Lang("painless").Param("parts", parts)).
+			ProceedOnVersionConflict().
+			Do(ctx)
+		if err != nil {
+			return err
+		}
+		if res.VersionConflicts == 0 {
+			return nil
+		}
+		if attempt == MAX_PART_MOVE_ATTEMPTS {
+			log.Warn("parts still hold moved offers", "conflicts", res.VersionConflicts, "attempts", attempt)
+			return nil
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// sweepParts removes the offers a finished full run did not write and the
+// parts left without offers.
+func sweepParts(ctx context.Context, run string, log *slog.Logger) {
+	res, err := elasticClient.UpdateByQuery("part").
+		Query(elastic.NewNestedQuery("offers", elastic.NewBoolQuery().
+			MustNot(elastic.NewTermQuery("offers.run", run)))).
+		Script(elastic.NewScript(partSweepScript).Lang("painless").Param("run", run)).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	checkErr(err)
+	log.Info("stale part offers removed", "parts_updated", res.Updated, "parts_deleted", res.Deleted, "conflicts", res.VersionConflicts)
+}
+
+// partUpdateRequest merges one offer into its part document, creating the part when needed.
+func partUpdateRequest(part PartContent) *elastic.BulkUpdateRequest {
+	script := elastic.NewScript(partOfferScript).
+		Lang("painless").
+		Params(map[string]interface{}{
+			"offer":            part.Offers[0],
+			"description":      part.Description,
+			"description_norm": part.DescriptionNorm,
+		})
+
+	return elastic.NewBulkUpdateRequest().
+		Index("part").
+		Type(bulkType("part")).
+		Id(part.ID).
+		RetryOnConflict(5).
+		Script(script).
+		Upsert(part)
+}
+
+// handlePartSearch serves /search/part?q=lm358&mfs=TI&currency=TWD&in_stock=1&sort=price
+func handlePartSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	from, err := intParam(q.Get("from"), 0)
+	if err != nil {
+		http.Error(w, "bad from", http.StatusBadRequest)
+		return
+	}
+	size, err := intParam(q.Get("size"), 10)
+	if err != nil {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+
+	inStock, err := boolParam(q.Get("in_stock"))
+	if err != nil {
+		http.Error(w, "bad in_stock", http.StatusBadRequest)
+		return
+	}
+
+	result, err := searchParts(r.Context(), q.Get("q"), q.Get("mfs"), inStock, q.Get("sort"), strings.ToUpper(q.Get("currency")), from, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// partSearchFields are matched against the text of a part search.
+var partSearchFields = []string{"pn", "mfs_canonical", "description", "description_norm"}
+
+func searchParts(ctx context.Context, text string, mfs string, inStock bool, sort string, currency string, from int, size int) (*PartResult, error) {
+	query := elastic.NewBoolQuery()
+	if text != "" {
+		query.Should(elastic.NewTermQuery("pn_norm", normPn(text)).Boost(10))
+		query.Should(elastic.NewPrefixQuery("pn_norm", normPn(text)).Boost(3))
+		query.Should(elastic.NewMultiMatchQuery(text, partSearchFields...))
+		for _, variant := range scriptVariants(text) {
+			query.Should(elastic.NewMultiMatchQuery(variant, partSearchFields...))
+		}
+		query.Should(elastic.NewNestedQuery("offers", elastic.NewMatchQuery("offers.supplier_pn", text)))
+		query.MinimumNumberShouldMatch(1)
+	} else {
+		query.Must(elastic.NewMatchAllQuery())
+	}
+
+	if mfs != "" {
+		_, canonical := mfsAliases.canonical(mfs)
+		query.Filter(elastic.NewTermQuery("mfs_canonical", canonical))
+	}
+	if inStock {
+		query.Filter(elastic.NewRangeQuery("total_stock").Gt(0))
+	}
+
+	search := newSearch().
+		Index("part").
+		Query(query).
+		From(from).Size(size)
+
+	switch sort {
+	case "price":
+		search = search.Sort("best_price_ref", true)
+	case "-price":
+		search = search.Sort("best_price_ref", false)
+	case "stock":
+		search = search.Sort("total_stock", true)
+	case "-stock":
+		search = search.Sort("total_stock", false)
+	}
+
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PartResult{
+		Took:  searchResult.TookInMillis,
+		Total: searchResult.TotalHits(),
+		Hits:  []PartHit{},
+	}
+
+	now := time.Now()
+	for _, hit := range searchResult.Hits.Hits {
+		var h PartHit
+		if err := json.Unmarshal(*hit.Source, &h.PartContent); err != nil {
+			return nil, err
+		}
+		if hit.Score != nil {
+			h.Score = *hit.Score
+		}
+
+		if currency != "" && h.BestPriceRef > 0 {
+			if price, ok := rates.convert(h.BestPriceRef, h.RefCurrency, currency, now); ok {
+				h.DisplayCurrency = currency
+				h.DisplayPrice = price
+			}
+		}
+
+		result.Hits = append(result.Hits, h)
+	}
+
+	return result, nil
+}
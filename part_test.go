@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPartAddOffer(t *testing.T) {
+	offer := func(productID int, inventory int, priceRef float64) PartContent {
+		return PartContent{
+			ID:          "ti|LM358",
+			Description: "op amp",
+			Offers:      []PartOffer{{ProductID: productID, Inventory: inventory, PriceRef: priceRef}},
+			OfferCount:  1,
+			TotalStock:  inventory,
+		}
+	}
+
+	p := offer(1, 100, 0.5)
+	p.addOffer(offer(2, 50, 0.3))
+	p.addOffer(offer(1, 10, 0))
+
+	if p.OfferCount != 2 || len(p.Offers) != 2 {
+		t.Fatalf("offer count = %d (%d offers), want 2", p.OfferCount, len(p.Offers))
+	}
+	if p.TotalStock != 60 {
+		t.Errorf("total stock = %d, want 60", p.TotalStock)
+	}
+	if p.BestPriceRef != 0.3 {
+		t.Errorf("best price = %v, want 0.3", p.BestPriceRef)
+	}
+}
+
+func TestBoolParam(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+		ok   bool
+	}{
+		{"", false, true},
+		{"1", true, true},
+		{"true", true, true},
+		{"0", false, true},
+		{"false", false, true},
+		{"maybe", false, false},
+	}
+	for _, tt := range tests {
+		got, err := boolParam(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("boolParam(%q) = %v, %v; want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHandlePartSearchRejectsBadInStock(t *testing.T) {
+	w := httptest.NewRecorder()
+	handlePartSearch(w, httptest.NewRequest("GET", "/search/part?q=lm358&in_stock=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// PROGRESS_BAR_WIDTH is the number of cells in the TTY progress bar
+const PROGRESS_BAR_WIDTH = 30
+
+// progress tracks a long run against an estimated total. Rows are source rows
+// read, docs are documents Elasticsearch answered for; percent and ETA follow docs.
+type progress struct {
+	total int64
+	rows  atomic.Int64
+	docs  atomic.Int64
+	start time.Time
+	tty   bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+var (
+	jobProgress *progress
+)
+
+// startProgress reports every second on a terminal and every ProgressInterval
+// seconds (30 by default) as log lines otherwise.
+func startProgress(total int64) *progress {
+	p := &progress{
+		total: total,
+		start: time.Now(),
+		tty:   term.IsTerminal(int(os.Stderr.Fd())),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	every := time.Second
+	if !p.tty {
+		every = 30 * time.Second
+		if appConfig.ProgressInterval > 0 {
+			every = time.Duration(appConfig.ProgressInterval) * time.Second
+		}
+	}
+
+	logger.Info("run started", "total", total)
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) addRows(n int) {
+	if p != nil {
+		p.rows.Add(int64(n))
+	}
+}
+
+func (p *progress) addDocs(n int) {
+	if p != nil {
+		p.docs.Add(int64(n))
+	}
+}
+
+// finish stops reporting and prints the final numbers.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.report()
+	if p.tty {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progress) report() {
+	rows, docs := p.rows.Load(), p.docs.Load()
+	elapsed := time.Since(p.start)
+	rowRate := float64(rows) / elapsed.Seconds()
+	docRate := float64(docs) / elapsed.Seconds()
+
+	// reltuples is an estimate, so the count can overshoot it
+	total := p.total
+	if docs > total {
+		total = docs
+	}
+	var percent float64
+	if total > 0 {
+		percent = float64(docs) * 100 / float64(total)
+	}
+	var eta time.Duration
+	if docRate > 0 {
+		eta = time.Duration(float64(total-docs) / docRate * float64(time.Second))
+	}
+
+	if p.tty {
+		filled := int(percent / 100 * PROGRESS_BAR_WIDTH)
+		bar := strings.Repeat("#", filled) + strings.Repeat(".", PROGRESS_BAR_WIDTH-filled)
+		fmt.Fprintf(os.Stderr, "\r[%s] %5.1f%%  %d/%d docs  %.0f rows/s  %.0f docs/s  ETA %s   ",
+			bar, percent, docs, total, rowRate, docRate, eta.Round(time.Second))
+		return
+	}
+
+	logger.Info("progress",
+		"percent", fmt.Sprintf("%.1f", percent),
+		"rows", rows, "docs", docs, "total", total,
+		"rows_per_sec", fmt.Sprintf("%.0f", rowRate),
+		"docs_per_sec", fmt.Sprintf("%.0f", docRate),
+		"elapsed", elapsed.Round(time.Second).String(),
+		"eta", eta.Round(time.Second).String())
+}
+
+// estimateRows reads the planner's row estimate for a Postgres table, which is
+// instant on large tables, and counts only when the table was never analyzed
+// or ExactCount is set.
+func estimateRows(db *sql.DB, table string) int64 {
+	var n int64
+	if !appConfig.ExactCount {
+		err := db.QueryRow("SELECT coalesce(reltuples, -1)::bigint FROM pg_class WHERE oid = to_regclass($1)", table).Scan(&n)
+		if err == nil && n > 0 {
+			return n
+		}
+	}
+	return countRows(db, fmt.Sprintf("SELECT count(*) FROM %s", table))
+}
+
+func countRows(db *sql.DB, sqlstr string, args ...interface{}) int64 {
+	var n int64
+	if err := db.QueryRow(sqlstr, args...).Scan(&n); err != nil {
+		logger.Warn("cannot count source rows, progress has no total", "err", err)
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,35 @@
+#!/bin/sh
+# Regenerates t2s_chars.go, the Traditional -> Simplified character table used
+# by normalizeScript, from ICU's Traditional-Simplified transliterator (Unihan
+# kSimplifiedVariant, the data OpenCC's TSCharacters is built on).
+#
+#   scripts/gen_t2s.sh > t2s_chars.go && gofmt -l t2s_chars.go
+#
+# Needs uconv (icu-devtools) and python3.
+set -eu
+
+python3 - "$@" <<'PY'
+import subprocess
+
+ranges = [(0x3400, 0x4DBF), (0x4E00, 0x9FFF), (0xF900, 0xFAFF), (0x20000, 0x2FA1F)]
+chars = [chr(c) for lo, hi in ranges for c in range(lo, hi + 1)]
+out = subprocess.run(["uconv", "-f", "utf-8", "-t", "utf-8", "-x", "Traditional-Simplified"],
+                     input="\n".join(chars).encode(), capture_output=True, check=True).stdout.decode()
+
+pairs = [t + s for t, s in zip(chars, out.split("\n")) if len(s) == 1 and s != t]
+
+# Taiwan forms ICU leaves alone but the product data uses: 矽 silicon, 甦醒
+pairs += ["矽硅", "甦苏"]
+
+print("// Code generated by scripts/gen_t2s.sh; DO NOT EDIT.")
+print()
+print("package main")
+print()
+print("// t2sChars lists Traditional/Simplified character pairs. Only the")
+print("// Traditional -> Simplified direction is used: it is many-to-one (發/髮 -> 发),")
+print("// so folding both documents and queries onto Simplified makes them comparable.")
+print("const t2sChars = `")
+for i in range(0, len(pairs), 20):
+    print(" ".join(pairs[i:i + 20]))
+print("`")
+PY
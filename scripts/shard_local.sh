@@ -0,0 +1,50 @@
+#!/bin/sh
+# Runs a sharded product index on one machine: a coordinator and WORKERS
+# worker processes, one of which is killed mid-run. Its shard must be taken
+# over after LockTTL and the run must end with every shard done.
+#
+#   go build -o gonews_index . && scripts/shard_local.sh
+#
+# Uses config.toml and APP_ENV like any other run; PGURL is passed to psql to
+# read the shard table (e.g. postgres://indexer@localhost/pm).
+set -eu
+
+BIN=${BIN:-./gonews_index}
+WORKERS=${WORKERS:-3}
+KILL_AFTER=${KILL_AFTER:-20}
+PGURL=${PGURL:?set PGURL for psql}
+LOGS=$(mktemp -d)
+
+echo "logs in $LOGS"
+"$BIN" product-sharded >"$LOGS/coordinator.log" 2>&1 &
+coordinator=$!
+sleep 5
+
+pids=""
+i=1
+while [ "$i" -le "$WORKERS" ]; do
+	"$BIN" work >"$LOGS/worker-$i.log" 2>&1 &
+	pids="$pids $!"
+	i=$((i + 1))
+done
+
+sleep "$KILL_AFTER"
+victim=$(echo $pids | cut -d' ' -f1)
+echo "killing worker $victim"
+kill -9 "$victim"
+
+status=0
+wait "$coordinator" || status=$?
+for pid in $pids; do
+	wait "$pid" 2>/dev/null || true
+done
+
+psql "$PGURL" -c "SELECT status, count(*), sum(attempts) attempts, sum(rows) rows
+	FROM index_shard WHERE run_id = (SELECT run_id FROM index_shard ORDER BY created_at DESC LIMIT 1)
+	GROUP BY status"
+
+if [ "$status" -ne 0 ]; then
+	echo "coordinator failed, see $LOGS/coordinator.log"
+	exit 1
+fi
+echo "all shards done"
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// ProductHit (Models)
+type ProductHit struct {
+	ProductSearchContent
+	Score              float64      `json:"score"`
+	DisplayCurrency    string       `json:"display_currency,omitempty"`
+	DisplayPrice       float64      `json:"display_price,omitempty"`
+	DisplayPriceBreaks []PriceBreak `json:"display_price_breaks,omitempty"`
+}
+
+// ProductResult (Models)
+type ProductResult struct {
+	Took  int64        `json:"took"`
+	Total int64        `json:"total"`
+	Hits  []ProductHit `json:"hits"`
+}
+
+type productSearchOptions struct {
+	Query    string
+	Currency string
+	Mfs      string
+	MinPrice float64
+	MaxPrice float64
+	Attrs    []attrFilter
+	Sort     string
+	From     int
+	Size     int
+}
+
+var productSearchFields = []string{"pn", "supplier_pn", "mfs", "supplier", "description", "description_norm", "param"}
+
+func serveSearch() {
+	addr := appConfig.Listen
+	if addr == "" {
+		addr = ":8080"
+	}
+
+	route("/search/product", handleProductSearch)
+	route("/search/part", handlePartSearch)
+	route("/search/news", handleNewsSearch)
+	route("/search", handleFederatedSearch)
+	route("/design/parts", handleDesignParts)
+	route("/part/designs", handlePartDesigns)
+	http.Handle("/metrics", promhttp.Handler())
+
+	logger.Info("search API listening", "addr", addr)
+	checkErr(http.ListenAndServe(addr, nil))
+}
+
+// route registers a search endpoint with latency metrics and a server span.
+func route(path string, h http.HandlerFunc) {
+	http.Handle(path, otelhttp.NewHandler(instrument(path, h), path))
+}
+
+// handleProductSearch serves /search/product?q=usb&mfs=TI&currency=TWD&min_price=1&max_price=10&sort=price
+// Parametric filters are passed as attr.<name>, e.g. attr.capacitance=10uF..22uF&attr.voltage=>=25V
+func handleProductSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	opts := productSearchOptions{
+		Query:    q.Get("q"),
+		Currency: strings.ToUpper(q.Get("currency")),
+		Mfs:      q.Get("mfs"),
+		Sort:     q.Get("sort"),
+	}
+
+	var err error
+	if opts.From, err = intParam(q.Get("from"), 0); err != nil {
+		http.Error(w, "bad from", http.StatusBadRequest)
+		return
+	}
+	if opts.Size, err = intParam(q.Get("size"), 10); err != nil {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+	if opts.MinPrice, err = floatParam(q.Get("min_price")); err != nil {
+		http.Error(w, "bad min_price", http.StatusBadRequest)
+		return
+	}
+	if opts.MaxPrice, err = floatParam(q.Get("max_price")); err != nil {
+		http.Error(w, "bad max_price", http.StatusBadRequest)
+		return
+	}
+	// a currency without a rate can neither show prices nor filter them
+	if opts.Currency != "" {
+		if _, ok := rates.rate(opts.Currency, time.Now()); !ok {
+			http.Error(w, "unknown currency "+opts.Currency, http.StatusBadRequest)
+			return
+		}
+	}
+
+	for key, values := range q {
+		if !strings.HasPrefix(key, "attr.") {
+			continue
+		}
+		for _, v := range values {
+			f, err := parseAttrFilter(strings.TrimPrefix(key, "attr."), v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			opts.Attrs = append(opts.Attrs, f)
+		}
+	}
+
+	result, err := searchProducts(r.Context(), opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+func searchProducts(ctx context.Context, opts productSearchOptions) (*ProductResult, error) {
+	now := time.Now()
+
+	query := elastic.NewBoolQuery()
+	if opts.Query != "" {
+		query.Must(productTextQuery(opts.Query))
+	} else {
+		query.Must(elastic.NewMatchAllQuery())
+	}
+
+	// Price filters are given in the display currency and compared on price_ref.
+	if opts.MinPrice > 0 || opts.MaxPrice > 0 {
+		from := opts.Currency
+		if from == "" {
+			from = rates.base
+		}
+
+		priceRange := elastic.NewRangeQuery("price_ref")
+		if opts.MinPrice > 0 {
+			min, ok := rates.convert(opts.MinPrice, from, rates.base, now)
+			if !ok {
+				return nil, fmt.Errorf("no exchange rate for %s", from)
+			}
+			priceRange.Gte(min)
+		}
+		if opts.MaxPrice > 0 {
+			max, ok := rates.convert(opts.MaxPrice, from, rates.base, now)
+			if !ok {
+				return nil, fmt.Errorf("no exchange rate for %s", from)
+			}
+			priceRange.Lte(max)
+		}
+		query.Filter(priceRange)
+	}
+
+	// Any spelling of a manufacturer filters on its canonical name.
+	if opts.Mfs != "" {
+		_, canonical := mfsAliases.canonical(opts.Mfs)
+		query.Filter(elastic.NewTermQuery("mfs_canonical", canonical))
+	}
+
+	for _, f := range opts.Attrs {
+		query.Filter(f.query())
+	}
+
+	search := newSearch().
+		Index("product").
+		Query(query).
+		From(opts.From).Size(opts.Size)
+
+	switch opts.Sort {
+	case "price":
+		search = search.Sort("price_ref", true)
+	case "-price":
+		search = search.Sort("price_ref", false)
+	case "inventory":
+		search = search.Sort("inventory", true)
+	case "-inventory":
+		search = search.Sort("inventory", false)
+	}
+
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ProductResult{
+		Took:  searchResult.TookInMillis,
+		Total: searchResult.TotalHits(),
+		Hits:  []ProductHit{},
+	}
+
+	for _, hit := range searchResult.Hits.Hits {
+		var h ProductHit
+		if err := json.Unmarshal(*hit.Source, &h.ProductSearchContent); err != nil {
+			return nil, err
+		}
+		if hit.Score != nil {
+			h.Score = *hit.Score
+		}
+
+		if opts.Currency != "" {
+			displayPrices(&h, opts.Currency, now)
+		}
+
+		result.Hits = append(result.Hits, h)
+	}
+
+	return result, nil
+}
+
+// productTextQuery matches the user's text against the product fields.
+func productTextQuery(text string) elastic.Query {
+	query := elastic.NewBoolQuery().
+		Should(elastic.NewMultiMatchQuery(text, productSearchFields...).Type("phrase_prefix")).
+		MinimumNumberShouldMatch(1)
+
+	// Traditional queries also match Simplified documents and vice versa
+	for _, variant := range scriptVariants(text) {
+		query.Should(elastic.NewMultiMatchQuery(variant, productSearchFields...).Type("phrase_prefix"))
+	}
+	if seg := segmentText(normalizeScript(text)); seg != "" {
+		query.Should(elastic.NewMatchQuery("description_seg", seg).Operator("and"))
+	}
+	return query
+}
+
+// displayPrices converts the offer prices into the user's currency.
+// Hits without a known rate are returned with their original currency only.
+func displayPrices(h *ProductHit, currency string, at time.Time) {
+	if len(h.PriceBreaks) == 0 {
+		return
+	}
+
+	price, ok := rates.convert(h.Price, h.Currency, currency, at)
+	if !ok {
+		return
+	}
+
+	h.DisplayCurrency = currency
+	h.DisplayPrice = price
+	for _, b := range h.PriceBreaks {
+		p, _ := rates.convert(b.Price, h.Currency, currency, at)
+		h.DisplayPriceBreaks = append(h.DisplayPriceBreaks, PriceBreak{Quantity: b.Quantity, Price: p})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("writing response failed", "err", err)
+	}
+}
+
+func intParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func boolParam(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+func floatParam(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cjkAnalyzers maps an analysis plugin to the index and search analyzers it provides,
+// in order of preference.
+var cjkAnalyzers = []struct {
+	Plugin string
+	Name   string
+	Index  string
+	Search string
+}{
+	{"analysis-ik", "ik", "ik_max_word", "ik_smart"},
+	{"analysis-smartcn", "smartcn", "smartcn", "smartcn"},
+	{"analysis-icu", "icu", "icu_analyzer", "icu_analyzer"},
+}
+
+type segmenter struct {
+	words  map[string]bool
+	maxLen int
+}
+
+var (
+	wordSegmenter *segmenter
+)
+
+// chooseCJKAnalyzer returns the index and search analyzers for Chinese text fields.
+// CJKAnalyzer in config forces one ("ik", "smartcn", "icu", "cjk", "standard");
+// otherwise the first plugin installed on every node wins and the built-in
+// bigram "cjk" analyzer is the fallback.
+func chooseCJKAnalyzer() (string, string) {
+	want := strings.ToLower(appConfig.CJKAnalyzer)
+	switch want {
+	case "cjk", "standard":
+		return want, want
+	}
+	for _, a := range cjkAnalyzers {
+		if want == a.Name {
+			return a.Index, a.Search
+		}
+	}
+
+	installed := clusterPlugins()
+	for _, a := range cjkAnalyzers {
+		if installed[a.Plugin] {
+			return a.Index, a.Search
+		}
+	}
+	return "cjk", "cjk"
+}
+
+// clusterPlugins lists the plugins that are installed on every node.
+func clusterPlugins() map[string]bool {
+	res, err := elasticClient.NodesInfo().Metric("plugins").Do(context.Background())
+	if err != nil {
+		logger.Warn("cannot list plugins, using built-in analyzers", "err", err)
+		return nil
+	}
+
+	count := map[string]int{}
+	for _, node := range res.Nodes {
+		for _, p := range node.Plugins {
+			count[p.Name]++
+		}
+	}
+
+	installed := map[string]bool{}
+	for name, n := range count {
+		if n == len(res.Nodes) {
+			installed[name] = true
+		}
+	}
+	return installed
+}
+
+// loadSegmenter reads a word list, one word per line; extra columns such as
+// jieba frequencies are ignored. Without a dictionary CJK text is split into bigrams.
+func loadSegmenter(name string) *segmenter {
+	s := &segmenter{words: map[string]bool{}}
+	if name == "" {
+		return s
+	}
+
+	f, err := os.Open(name)
+	checkErr(err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		word := fields[0]
+		s.words[word] = true
+		if n := utf8.RuneCountInString(word); n > s.maxLen {
+			s.maxLen = n
+		}
+	}
+	checkErr(scanner.Err())
+
+	logger.Info("segmentation dictionary loaded", "words", len(s.words), "file", name)
+	return s
+}
+
+// segment returns text as space separated tokens for the pre-tokenized *_seg
+// fields, which are indexed with the whitespace analyzer. Latin words and
+// numbers are lower-cased, CJK runs are cut by dictionary or into bigrams.
+func (s *segmenter) segment(text string) string {
+	var tokens []string
+	var word []rune
+	var han []rune
+
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	flushHan := func() {
+		if len(han) > 0 {
+			tokens = append(tokens, s.segmentHan(han)...)
+			han = han[:0]
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			han = append(han, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushHan()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushHan()
+		}
+	}
+	flushWord()
+	flushHan()
+
+	return strings.Join(tokens, " ")
+}
+
+func (s *segmenter) segmentHan(run []rune) []string {
+	if len(s.words) == 0 {
+		return bigrams(run)
+	}
+
+	// forward maximum matching; characters outside the dictionary are joined
+	// and emitted as bigrams so unknown names still match
+	var tokens []string
+	var unknown []rune
+	for i := 0; i < len(run); {
+		n := s.maxLen
+		if n > len(run)-i {
+			n = len(run) - i
+		}
+		for ; n > 1; n-- {
+			if s.words[string(run[i:i+n])] {
+				break
+			}
+		}
+		if n > 1 {
+			tokens = append(tokens, bigrams(unknown)...)
+			unknown = unknown[:0]
+			tokens = append(tokens, string(run[i:i+n]))
+		} else {
+			unknown = append(unknown, run[i])
+		}
+		i += n
+	}
+	return append(tokens, bigrams(unknown)...)
+}
+
+func bigrams(run []rune) []string {
+	if len(run) == 1 {
+		return []string{string(run)}
+	}
+	var tokens []string
+	for i := 0; i+1 < len(run); i++ {
+		tokens = append(tokens, string(run[i:i+2]))
+	}
+	return tokens
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// segmentText is a no-op unless Segment is enabled in config.
+func segmentText(text string) string {
+	if wordSegmenter == nil {
+		return ""
+	}
+	return wordSegmenter.segment(text)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SHARD_TABLE records the id ranges of sharded product runs
+const SHARD_TABLE = "index_shard"
+
+// SHARD_SIZE is the default width of a shard in fm_product ids
+const SHARD_SIZE = 100000
+
+// MAX_SHARD_ATTEMPTS is how often a shard is retried before it is marked failed
+const MAX_SHARD_ATTEMPTS = 3
+
+// SHARD_POLL is how often idle workers and the coordinator look at the table
+const SHARD_POLL = 10 * time.Second
+
+// shard (Models)
+type shard struct {
+	RunID    string
+	Shard    int
+	FromID   int64 // inclusive
+	ToID     int64 // exclusive
+	Attempts int
+}
+
+// Sharded product indexing spreads fm_product over any number of processes:
+//
+//	gonews_index product-sharded   # coordinator: splits the ids and waits
+//	gonews_index work &            # workers, on as many hosts as needed
+//	gonews_index work &
+//
+// Workers claim pending shards with FOR UPDATE SKIP LOCKED and heart-beat
+// while indexing. A shard whose worker stopped heart-beating for LockTTL
+// seconds is claimed again, so a dead worker's range is redone elsewhere.
+// scripts/shard_local.sh runs this on one machine and kills a worker mid-run.
+
+// coordinateShards is the product-sharded job. It holds the product lock, so
+// it does not overlap a plain product run.
+func coordinateShards(ctx context.Context, log *slog.Logger) {
+	ensureShardTable()
+
+	size := int64(SHARD_SIZE)
+	if appConfig.ShardSize > 0 {
+		size = int64(appConfig.ShardSize)
+	}
+
+	var minID, maxID sql.NullInt64
+	checkErr(dbpm.QueryRowContext(ctx, "SELECT min(id), max(id) FROM fm_product").Scan(&minID, &maxID))
+	if !minID.Valid {
+		logger.Info("fm_product is empty, nothing to shard")
+		return
+	}
+
+	runID := newRunID()
+	tx, err := dbpm.BeginTx(ctx, nil)
+	checkErr(err)
+	defer tx.Rollback()
+
+	// shards of an earlier coordinator that died are not worth finishing
+	_, err = tx.ExecContext(ctx, `UPDATE `+SHARD_TABLE+` SET status = 'cancelled'
+		WHERE status = 'pending' OR (status = 'running' AND heartbeat_at < now() - $1 * interval '1 second')`, shardTTL().Seconds())
+	checkErr(err)
+
+	var count int
+	for from := minID.Int64; from <= maxID.Int64; from += size {
+		_, err = tx.ExecContext(ctx, `INSERT INTO `+SHARD_TABLE+` (run_id, shard, from_id, to_id, status, attempts, rows, created_at)
+			VALUES ($1, $2, $3, $4, 'pending', 0, 0, now())`, runID, count, from, from+size)
+		checkErr(err)
+		count++
+	}
+	checkErr(tx.Commit())
+
+	log = log.With("shard_run", runID)
+	log.Info("shards created", "shards", count, "from_id", minID.Int64, "to_id", maxID.Int64, "size", size)
+
+	jobProgress = startProgress(estimateRows(dbpm, "fm_product"))
+	defer jobProgress.finish()
+
+	var indexed int64
+	for {
+		// a shard whose workers keep dying (OOM, a crash outside the batch
+		// recover) is not claimed again after its last attempt; give up on it
+		_, err := dbpm.ExecContext(ctx, `UPDATE `+SHARD_TABLE+` SET status = 'failed', finished_at = now()
+			WHERE run_id = $1 AND status = 'running' AND attempts >= $2 AND heartbeat_at < now() - $3 * interval '1 second'`,
+			runID, MAX_SHARD_ATTEMPTS, shardTTL().Seconds())
+		checkErr(err)
+
+		var pending, running, done, failed, rows int64
+		checkErr(dbpm.QueryRowContext(ctx, `SELECT
+				count(*) FILTER (WHERE status = 'pending'),
+				count(*) FILTER (WHERE status = 'running'),
+				count(*) FILTER (WHERE status = 'done'),
+				count(*) FILTER (WHERE status = 'failed'),
+				coalesce(sum(rows) FILTER (WHERE status = 'done'), 0)
+			FROM `+SHARD_TABLE+` WHERE run_id = $1`, runID).Scan(&pending, &running, &done, &failed, &rows))
+
+		jobProgress.addDocs(int(rows - indexed))
+		indexed = rows
+
+		if pending == 0 && running == 0 {
+			if failed > 0 {
+				checkErr(fmt.Errorf("%d of %d shards failed", failed, count))
+			}
+			log.Info("all shards done", "shards", done, "rows", rows)
+			sweepParts(ctx, runID, log)
+			return
+		}
+		log.Debug("waiting for workers", "pending", pending, "running", running, "done", done, "failed", failed)
+
+		select {
+		case <-ctx.Done():
+			checkErr(ctx.Err())
+		case <-time.After(SHARD_POLL):
+		}
+	}
+}
+
+// runShardWorker claims and indexes shards until none are pending or running.
+func runShardWorker() {
+	ensureShardTable()
+
+	worker := lockOwner()
+	log := logger.With("worker", worker)
+	log.Info("shard worker started")
+
+	for {
+		s, ok := claimShard(worker)
+		if ok {
+			indexShard(s, worker, log.With("shard_run", s.RunID, "shard", s.Shard))
+			continue
+		}
+
+		var active int
+		// stale shards out of attempts are left for the coordinator to fail
+		checkErr(dbpm.QueryRow(`SELECT count(*) FROM `+SHARD_TABLE+` WHERE status = 'pending'
+			OR (status = 'running' AND (attempts < $1 OR heartbeat_at >= now() - $2 * interval '1 second'))`,
+			MAX_SHARD_ATTEMPTS, shardTTL().Seconds()).Scan(&active))
+		if active == 0 {
+			log.Info("no shards left, exiting")
+			return
+		}
+		// others are still working; their shards come back if they die
+		time.Sleep(SHARD_POLL)
+	}
+}
+
+// claimShard takes the next pending shard, or a running one whose worker went
+// quiet. SKIP LOCKED keeps concurrent workers from waiting on each other.
+func claimShard(worker string) (s shard, ok bool) {
+	err := dbpm.QueryRow(`UPDATE `+SHARD_TABLE+` SET status = 'running', worker = $1, heartbeat_at = now(), attempts = attempts + 1
+		WHERE (run_id, shard) = (
+			SELECT run_id, shard FROM `+SHARD_TABLE+`
+			WHERE status = 'pending' OR (status = 'running' AND heartbeat_at < now() - $2 * interval '1 second' AND attempts < $3)
+			ORDER BY created_at, shard
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING run_id, shard, from_id, to_id, attempts`, worker, shardTTL().Seconds(), MAX_SHARD_ATTEMPTS).
+		Scan(&s.RunID, &s.Shard, &s.FromID, &s.ToID, &s.Attempts)
+	if err == sql.ErrNoRows {
+		return s, false
+	}
+	checkErr(err)
+	return s, true
+}
+
+// indexShard indexes ids in [FromID, ToID) in LIMIT_SIZE batches. A shard with
+// failed batches goes back to pending until MAX_SHARD_ATTEMPTS is reached.
+func indexShard(s shard, worker string, log *slog.Logger) {
+	ctx, span := tracer.Start(context.Background(), "indexShard", trace.WithAttributes(
+		attribute.Int("shard", s.Shard), attribute.Int64("from_id", s.FromID), attribute.Int64("to_id", s.ToID)))
+	defer span.End()
+
+	ctx, panics := withPanicCounter(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go shardHeartbeat(ctx, cancel, s, worker, log)
+
+	// the offers carry the run id, so the coordinator can sweep the ones no shard wrote
+	partRun = s.RunID
+
+	log.Info("shard claimed", "from_id", s.FromID, "to_id", s.ToID, "attempt", s.Attempts)
+	start := time.Now()
+
+	sqlstr := `SELECT id, pn, supplier_pn, coalesce(mfs, '') mfs, "catalog", description, param, supplier, inventory, currency, offical_price FROM fm_product WHERE id >= $1 AND id < $2 order by id limit $3`
+	var total, failed int
+	for from := s.FromID; ctx.Err() == nil; {
+		count, last, n := indexProductRows(ctx, log.With("from_id", from), sqlstr, from, s.ToID, LIMIT_SIZE)
+		total += count
+		failed += n
+		if count < LIMIT_SIZE {
+			break
+		}
+		from = last + 1
+	}
+
+	status := "done"
+	if panics.Load() > 0 || failed > 0 || ctx.Err() != nil {
+		status = "pending"
+		if s.Attempts >= MAX_SHARD_ATTEMPTS {
+			status = "failed"
+		}
+	}
+
+	// only the current owner may finish the shard; after a takeover it is
+	// someone else's, and a newer coordinator may have cancelled it
+	_, err := dbpm.Exec(`UPDATE `+SHARD_TABLE+` SET status = $4, rows = $5, finished_at = now()
+		WHERE run_id = $1 AND shard = $2 AND worker = $3 AND status = 'running'`, s.RunID, s.Shard, worker, status, total)
+	checkErr(err)
+
+	log.Info("shard finished", "status", status, "rows", total, "failed_docs", failed, "elapsed", time.Since(start).String())
+}
+
+// shardHeartbeat keeps the claim alive and cancels the shard when another
+// worker has taken it over.
+func shardHeartbeat(ctx context.Context, cancel context.CancelFunc, s shard, worker string, log *slog.Logger) {
+	ticker := time.NewTicker(shardTTL() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := dbpm.ExecContext(ctx, `UPDATE `+SHARD_TABLE+` SET heartbeat_at = now()
+			WHERE run_id = $1 AND shard = $2 AND worker = $3 AND status = 'running'`, s.RunID, s.Shard, worker)
+		if err != nil {
+			log.Warn("shard heartbeat failed", "err", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Error("shard taken over by another worker, stopping")
+			cancel()
+			return
+		}
+	}
+}
+
+func shardTTL() time.Duration {
+	if appConfig.LockTTL > 0 {
+		return time.Duration(appConfig.LockTTL) * time.Second
+	}
+	return 60 * time.Second
+}
+
+func ensureShardTable() {
+	_, err := dbpm.Exec(`CREATE TABLE IF NOT EXISTS ` + SHARD_TABLE + ` (
+		run_id       text NOT NULL,
+		shard        int NOT NULL,
+		from_id      bigint NOT NULL,
+		to_id        bigint NOT NULL,
+		status       text NOT NULL,
+		worker       text,
+		attempts     int NOT NULL DEFAULT 0,
+		rows         bigint NOT NULL DEFAULT 0,
+		created_at   timestamptz NOT NULL,
+		heartbeat_at timestamptz,
+		finished_at  timestamptz,
+		PRIMARY KEY (run_id, shard)
+	)`)
+	checkErr(err)
+
+	_, err = dbpm.Exec(`CREATE INDEX IF NOT EXISTS ` + SHARD_TABLE + `_status ON ` + SHARD_TABLE + ` (status, created_at)`)
+	checkErr(err)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic"
+	"golang.org/x/time/rate"
+)
+
+// MAX_BULK_RETRIES is how often documents rejected with 429 are resent
+const MAX_BULK_RETRIES = 5
+
+// THROTTLE_STEP_AFTER is the number of healthy bulk responses before the
+// throttle opens up by one step
+const THROTTLE_STEP_AFTER = 5
+
+// CLUSTER_WATCH_INTERVAL is how often cluster health and thread pool rejections are read
+const CLUSTER_WATCH_INTERVAL = 15 * time.Second
+
+// throttle adapts the number of concurrent bulk requests and the documents
+// per request to Elasticsearch back-pressure (AIMD): every run of healthy
+// responses adds one request slot and grows the batch, a 429, a rejected
+// write thread or a red cluster halves both, slow responses shrink the batch.
+// A fixed docs/sec ceiling applies on top when MaxDocsPerSec is set.
+type throttle struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+	limit  int
+	batch  int
+	good   int
+	health string
+
+	minLimit, maxLimit int
+	minBatch, maxBatch int
+	target             time.Duration
+
+	limiter *rate.Limiter
+	hours   [2]int // ceiling applies from hours[0] to hours[1] local time; equal means always
+}
+
+var (
+	jobThrottle *throttle
+)
+
+// newThrottle starts at the configured maxima and backs off from there.
+// MaxWorkers (10), MinBulkSize (100), MaxBulkSize (BULK_SIZE) and
+// TargetBulkLatency (2000 ms) bound it.
+func newThrottle() *throttle {
+	t := &throttle{
+		minLimit: 1,
+		maxLimit: maxWorkers(),
+		minBatch: 100,
+		maxBatch: BULK_SIZE,
+		target:   2 * time.Second,
+		health:   "green",
+	}
+	if appConfig.MinBulkSize > 0 {
+		t.minBatch = appConfig.MinBulkSize
+	}
+	if appConfig.MaxBulkSize > 0 {
+		t.maxBatch = appConfig.MaxBulkSize
+	}
+	if t.minBatch > t.maxBatch {
+		t.minBatch = t.maxBatch
+	}
+	if appConfig.TargetBulkLatency > 0 {
+		t.target = time.Duration(appConfig.TargetBulkLatency) * time.Millisecond
+	}
+	t.limit, t.batch = t.maxLimit, t.maxBatch
+	t.cond = sync.NewCond(&t.mu)
+
+	if appConfig.MaxDocsPerSec > 0 {
+		t.limiter = rate.NewLimiter(rate.Limit(appConfig.MaxDocsPerSec), t.maxBatch)
+		if appConfig.MaxDocsPerSecHours != "" {
+			_, err := fmt.Sscanf(appConfig.MaxDocsPerSecHours, "%d-%d", &t.hours[0], &t.hours[1])
+			checkErr(err)
+		}
+	}
+
+	t.publish()
+	return t
+}
+
+// maxWorkers is the size of the product worker pool.
+func maxWorkers() int {
+	if appConfig.MaxWorkers > 0 {
+		return appConfig.MaxWorkers
+	}
+	return 10
+}
+
+// batchSize is the number of documents the next bulk request should carry.
+func (t *throttle) batchSize() int {
+	if t == nil {
+		return BULK_SIZE
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.batch
+}
+
+// acquire waits for the docs/sec ceiling and a free request slot. The returned
+// function frees the slot. It gives up with ctx's error once ctx is done.
+func (t *throttle) acquire(ctx context.Context, docs int) (func(), error) {
+	if t == nil {
+		return func() {}, ctx.Err()
+	}
+
+	if t.limiter != nil && t.ceilingActive(time.Now()) {
+		for docs > 0 {
+			n := docs
+			if n > t.maxBatch {
+				n = t.maxBatch
+			}
+			if err := t.limiter.WaitN(ctx, n); err != nil {
+				return nil, err
+			}
+			docs -= n
+		}
+	}
+
+	// cond.Wait cannot watch ctx, so cancelling ctx wakes the waiters up
+	stop := context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		t.cond.Broadcast()
+		t.mu.Unlock()
+	})
+	defer stop()
+
+	t.mu.Lock()
+	for t.active >= t.limit && ctx.Err() == nil {
+		t.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+	t.active++
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		t.active--
+		t.cond.Broadcast()
+		t.mu.Unlock()
+	}, nil
+}
+
+// ceilingActive reports whether MaxDocsPerSec applies at now, e.g. "8-20" for office hours.
+func (t *throttle) ceilingActive(now time.Time) bool {
+	from, to := t.hours[0], t.hours[1]
+	if from == to {
+		return true
+	}
+	h := now.Hour()
+	if from < to {
+		return h >= from && h < to
+	}
+	return h >= from || h < to
+}
+
+// observe feeds the outcome of one request back into the controller.
+func (t *throttle) observe(latency time.Duration, rejected bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case rejected:
+		t.backOff("rejected")
+	case latency > t.target:
+		t.good = 0
+		t.batch = max(t.minBatch, t.batch*3/4)
+	default:
+		t.good++
+		if t.good >= THROTTLE_STEP_AFTER && t.health == "green" {
+			t.good = 0
+			t.limit = min(t.maxLimit, t.limit+1)
+			t.batch = min(t.maxBatch, t.batch+t.minBatch)
+		}
+	}
+	t.publish()
+	t.cond.Broadcast()
+}
+
+// backOff halves concurrency and batch size; callers hold t.mu.
+func (t *throttle) backOff(reason string) {
+	t.good = 0
+	t.limit = max(t.minLimit, t.limit/2)
+	t.batch = max(t.minBatch, t.batch/2)
+	logger.Warn("elasticsearch back-pressure, slowing down", "reason", reason, "concurrency", t.limit, "batch", t.batch)
+}
+
+func (t *throttle) publish() {
+	throttleConcurrency.Set(float64(t.limit))
+	throttleBatchSize.Set(float64(t.batch))
+}
+
+// watchCluster polls cluster health and write thread pool rejections until ctx
+// is done. Red health pins the throttle at its minimum; yellow stops growth.
+func (t *throttle) watchCluster(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(CLUSTER_WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	var lastRejected int64 = -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		health, err := elasticClient.ClusterHealth().Do(ctx)
+		if err != nil {
+			logger.Warn("cannot read cluster health", "err", err)
+			continue
+		}
+		rejected, ok := writeRejections(ctx)
+		if !ok {
+			logger.Warn("cannot read thread pool rejections")
+		}
+
+		t.mu.Lock()
+		t.health = health.Status
+		switch {
+		case health.Status == "red":
+			t.limit, t.batch, t.good = t.minLimit, t.minBatch, 0
+			logger.Warn("cluster is red, throttling to minimum")
+		case ok && lastRejected >= 0 && rejected > lastRejected:
+			t.backOff(fmt.Sprintf("%d write thread pool rejections", rejected-lastRejected))
+		}
+		t.publish()
+		t.mu.Unlock()
+
+		if ok {
+			lastRejected = rejected
+		}
+	}
+}
+
+// writeRejections sums rejected tasks of the write (bulk before 6.3) thread
+// pools. ok is false when the node stats could not be read.
+func writeRejections(ctx context.Context) (n int64, ok bool) {
+	res, err := elasticClient.NodesStats().Metric("thread_pool").Do(ctx)
+	if err != nil {
+		return 0, false
+	}
+	for _, node := range res.Nodes {
+		for _, name := range []string{"write", "bulk"} {
+			if pool, ok := node.ThreadPool[name]; ok && pool != nil {
+				n += pool.Rejected
+			}
+		}
+	}
+	return n, true
+}
+
+// sendBulk sends reqs to Elasticsearch and resends the items rejected with 429
+// after a back-off. It returns the number of items indexed and failed.
+func sendBulk(ctx context.Context, index string, reqs []elastic.BulkableRequest, log *slog.Logger) (indexed int, failed int, err error) {
+	pending := reqs
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return indexed, failed, ctx.Err()
+			case <-time.After(retryBackoff(attempt)):
+			}
+		}
+
+		release, err := jobThrottle.acquire(ctx, len(pending))
+		if err != nil {
+			return indexed, failed, err
+		}
+		bulkBatchSize.WithLabelValues(index).Observe(float64(len(pending)))
+		sent := time.Now()
+		res, err := elasticClient.Bulk().Add(pending...).Do(ctx)
+		latency := time.Since(sent)
+		bulkSeconds.WithLabelValues(index).Observe(latency.Seconds())
+		release()
+
+		if err != nil {
+			overloaded := elastic.IsStatusCode(err, 429)
+			jobThrottle.observe(latency, overloaded)
+			if overloaded && attempt < MAX_BULK_RETRIES {
+				bulkRejected.WithLabelValues(index).Add(float64(len(pending)))
+				continue
+			}
+			return indexed, failed, err
+		}
+
+		var retry []elastic.BulkableRequest
+		for i, item := range res.Items {
+			for _, r := range item {
+				switch {
+				case r.Status >= 200 && r.Status < 300:
+					docsIndexed.WithLabelValues(r.Index).Inc()
+					indexed++
+				case r.Status == 429 && attempt < MAX_BULK_RETRIES:
+					retry = append(retry, pending[i])
+				default:
+					docsFailed.WithLabelValues(r.Index).Inc()
+					failed++
+					reason := ""
+					if r.Error != nil {
+						reason = r.Error.Reason
+					}
+					log.Warn("bulk item failed", "target", r.Index, "type", r.Type, "id", r.Id, "status", r.Status, "reason", reason)
+				}
+			}
+		}
+
+		bulkRejected.WithLabelValues(index).Add(float64(len(retry)))
+		jobThrottle.observe(latency, len(retry) > 0)
+		pending = retry
+	}
+	return indexed, failed, nil
+}
+
+// retryBackoff doubles from half a second up to 30 seconds.
+func retryBackoff(attempt int) time.Duration {
+	d := time.Duration(1<<uint(attempt-1)) * 500 * time.Millisecond
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d
+}
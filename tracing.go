@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SERVICE_NAME identifies this program in traces
+const SERVICE_NAME = "gonews_index"
+
+var tracer = otel.Tracer(SERVICE_NAME)
+
+// initTracing installs the tracer provider chosen by TraceExporter: "otlp"
+// sends to TraceEndpoint (or the OTEL_EXPORTER_OTLP_* environment), "file"
+// writes JSON spans to TraceFile. Tracing is a no-op when unset. The returned
+// function flushes pending spans.
+func initTracing(job string) func() {
+	var exporter sdktrace.SpanExporter
+	var err error
+	ctx := context.Background()
+
+	switch appConfig.TraceExporter {
+	case "":
+		return func() {}
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if appConfig.TraceEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(appConfig.TraceEndpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "file":
+		name := appConfig.TraceFile
+		if name == "" {
+			name = "traces.json"
+		}
+		var f *os.File
+		f, err = os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		logger.Warn("unknown trace exporter, tracing disabled", "exporter", appConfig.TraceExporter)
+		return func() {}
+	}
+	checkErr(err)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", SERVICE_NAME),
+			attribute.String("job", job),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	logger.Info("tracing enabled", "exporter", appConfig.TraceExporter)
+	return func() {
+		if err := provider.Shutdown(ctx); err != nil {
+			logger.Warn("flushing traces failed", "err", err)
+		}
+	}
+}
+
+// tracedHTTPClient is the Elasticsearch client's transport; each request
+// becomes a child span of the caller's context.
+func tracedHTTPClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{Transport: otelhttp.NewTransport(transport)}
+}
+
+// markFailed records an error or a recovered panic value on span.
+func markFailed(span trace.Span, v interface{}) {
+	err, ok := v.(error)
+	if !ok {
+		err = fmt.Errorf("%v", v)
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PriceBreak (Models)
+type PriceBreak struct {
+	Quantity int     `json:"quantity"`
+	Price    float64 `json:"price"`
+}
+
+// currencySymbols maps the currency spellings seen in fm_product to ISO 4217 codes.
+// Longer spellings are matched first so "NT$" wins over "$".
+var currencySymbols = map[string]string{
+	"US$": "USD",
+	"USD": "USD",
+	"$":   "USD",
+	"NT$": "TWD",
+	"NTD": "TWD",
+	"TWD": "TWD",
+	"新台幣": "TWD",
+	"台幣":  "TWD",
+	"RMB": "CNY",
+	"CNY": "CNY",
+	"人民幣": "CNY",
+	"人民币": "CNY",
+	"￥":   "CNY",
+	"¥":   "CNY",
+	"JP¥": "JPY",
+	"JPY": "JPY",
+	"円":   "JPY",
+	"HK$": "HKD",
+	"HKD": "HKD",
+	"€":   "EUR",
+	"EUR": "EUR",
+	"£":   "GBP",
+	"GBP": "GBP",
+}
+
+// isoCurrencies holds the active ISO 4217 codes; a currency column holding any
+// other word, such as "TBD", names no currency.
+var isoCurrencies = wordSet(`
+	AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB
+	BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP
+	DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL HTG HUF
+	IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK
+	LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN
+	NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF
+	SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND
+	TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER
+	ZAR ZMW ZWL`)
+
+func wordSet(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		set[w] = true
+	}
+	return set
+}
+
+// currencySymbolsByLength holds the keys of currencySymbols, longest first.
+var currencySymbolsByLength = sortedCurrencySymbols()
+
+func sortedCurrencySymbols() []string {
+	symbols := make([]string, 0, len(currencySymbols))
+	for sym := range currencySymbols {
+		symbols = append(symbols, sym)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if len(symbols[i]) != len(symbols[j]) {
+			return len(symbols[i]) > len(symbols[j])
+		}
+		return symbols[i] < symbols[j]
+	})
+	return symbols
+}
+
+// multipliedNumber matches counts such as "1.5k" or "2 M".
+var multipliedNumber = regexp.MustCompile(`^(\d+(?:[.,]\d+)?)\s*([kKM])$`)
+
+// transformProduct turns a raw fm_product row into the typed search document.
+func transformProduct(p ProductContent) ProductSearchContent {
+	inventory, exact := parseInventory(p.Inventory)
+	breaks, currency := parsePrice(p.OfficialPrice, p.Currency)
+
+	doc := ProductSearchContent{
+		Timestamp:       time.Now(),
+		Currency:        currency,
+		CurrencyRaw:     p.Currency,
+		OfficalPrice:    p.OfficialPrice,
+		PriceBreaks:     breaks,
+		Description:     p.Description,
+		DescriptionNorm: scriptVariant(p.Description),
+		DescriptionSeg:  segmentText(normalizeScript(p.Description)),
+		Inventory:       inventory,
+		InventoryRaw:    p.Inventory,
+		InventoryExact:  exact,
+		Catalog:         p.Catalog,
+		Pn:              p.Pn,
+		Supplier:        p.Supplier,
+		SupplierPn:      p.SupplierPn,
+		ID:              int(p.ID),
+		Mfs:             p.Mfs,
+		Param:           p.Param,
+		Attrs:           parseParam(p.Param),
+	}
+	doc.MfsID, doc.MfsCanonical = mfsAliases.canonical(p.Mfs)
+
+	if len(breaks) > 0 {
+		doc.Price = breaks[0].Price
+
+		if rates != nil {
+			if ref, ok := rates.convert(doc.Price, currency, rates.base, doc.Timestamp); ok {
+				doc.PriceRef = ref
+				doc.RefCurrency = rates.base
+			}
+		}
+	}
+
+	return doc
+}
+
+// parseInventory reads strings such as "1,200", ">1000", "500+" or "N/A".
+// exact is false when the value is a bound, an estimate or missing.
+func parseInventory(s string) (n int, exact bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+
+	exact = true
+	for _, prefix := range []string{">=", "<=", ">", "<", "~", "≥", "≤", "約", "约"} {
+		if strings.HasPrefix(s, prefix) {
+			s = strings.TrimSpace(strings.TrimPrefix(s, prefix))
+			exact = false
+		}
+	}
+	if strings.HasSuffix(s, "+") {
+		s = strings.TrimSpace(strings.TrimSuffix(s, "+"))
+		exact = false
+	}
+
+	// a k or M multiplies only when it directly follows the number, so the
+	// trailing k of "35 in stock" is not read as thousands
+	if m := multipliedNumber.FindStringSubmatch(s); m != nil {
+		v, ok := parseNumber(m[1])
+		if !ok {
+			return 0, false
+		}
+		multiplier := 1000.0
+		if m[2] == "M" {
+			multiplier = 1000000
+		}
+		return int(math.Round(v * multiplier)), false
+	}
+
+	if v, ok := parseNumber(s); ok {
+		return int(math.Round(v)), exact && v == math.Trunc(v)
+	}
+
+	// Fall back to the first run of digits, e.g. "In stock: 35 pcs".
+	digits := firstNumber(s)
+	if digits == "" {
+		return 0, false
+	}
+	v, ok := parseNumber(digits)
+	if !ok {
+		return 0, false
+	}
+	return int(math.Round(v)), false
+}
+
+// parsePrice reads a single price or a quantity-break table such as
+// "1:0.52;10:0.45", "1+ $0.52 | 10+ $0.45" or a JSON array of breaks.
+// Breaks are returned sorted by quantity together with the ISO currency code.
+func parsePrice(s string, currency string) ([]PriceBreak, string) {
+	code := currencyCode(currency)
+	if code == "" {
+		code = currencyCode(s)
+	}
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, code
+	}
+
+	var breaks []PriceBreak
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		breaks = parsePriceJSON(s)
+	} else {
+		for _, seg := range strings.FieldsFunc(s, func(r rune) bool {
+			return r == ';' || r == '|' || r == '\n' || r == '\r'
+		}) {
+			if b, ok := parsePriceBreak(seg); ok {
+				breaks = append(breaks, b)
+			}
+		}
+	}
+
+	sort.SliceStable(breaks, func(i, j int) bool {
+		return breaks[i].Quantity < breaks[j].Quantity
+	})
+
+	return breaks, code
+}
+
+func parsePriceBreak(seg string) (PriceBreak, bool) {
+	seg = strings.TrimSpace(seg)
+	if seg == "" {
+		return PriceBreak{}, false
+	}
+
+	for _, sep := range []string{":", "=", "+", "\t"} {
+		if i := strings.Index(seg, sep); i > 0 {
+			qty, qok := parseNumber(stripCurrency(seg[:i]))
+			price, pok := parseNumber(stripCurrency(seg[i+len(sep):]))
+			if qok && pok {
+				return PriceBreak{Quantity: int(qty), Price: price}, true
+			}
+		}
+	}
+
+	// "10 0.45" style tables separated by whitespace.
+	if f := strings.Fields(seg); len(f) == 2 {
+		qty, qok := parseNumber(stripCurrency(f[0]))
+		price, pok := parseNumber(stripCurrency(f[1]))
+		if qok && pok {
+			return PriceBreak{Quantity: int(qty), Price: price}, true
+		}
+	}
+
+	price, ok := parseNumber(stripCurrency(seg))
+	if !ok {
+		return PriceBreak{}, false
+	}
+	return PriceBreak{Quantity: 1, Price: price}, true
+}
+
+func parsePriceJSON(s string) []PriceBreak {
+	var rows []map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &rows); err != nil {
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &row); err != nil {
+			return nil
+		}
+		rows = append(rows, row)
+	}
+
+	var breaks []PriceBreak
+	for _, row := range rows {
+		qty, qok := jsonNumber(row, "quantity", "qty", "break", "min")
+		price, pok := jsonNumber(row, "price", "unit_price", "value")
+		if !pok {
+			continue
+		}
+		if !qok {
+			qty = 1
+		}
+		breaks = append(breaks, PriceBreak{Quantity: int(qty), Price: price})
+	}
+	return breaks
+}
+
+func jsonNumber(row map[string]interface{}, keys ...string) (float64, bool) {
+	for _, k := range keys {
+		switch v := row[k].(type) {
+		case float64:
+			return v, true
+		case string:
+			if n, ok := parseNumber(stripCurrency(v)); ok {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// currencyCode finds an ISO 4217 code in a currency column or price string.
+func currencyCode(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+
+	if code, ok := currencySymbols[strings.ToUpper(s)]; ok {
+		return code
+	}
+
+	upper := strings.ToUpper(s)
+	for _, sym := range currencySymbolsByLength {
+		if strings.Contains(upper, sym) {
+			return currencySymbols[sym]
+		}
+	}
+
+	if isoCurrencies[upper] || (rates != nil && rates.known(upper)) {
+		return upper
+	}
+	return ""
+}
+
+// stripCurrency drops everything except digits, separators and sign.
+func stripCurrency(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || r == '.' || r == ',' || r == '-' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// parseNumber parses "1,234.50", "1.234,50" and "0,52" style numbers.
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(strings.Replace(s, " ", "", -1))
+	if s == "" {
+		return 0, false
+	}
+
+	comma := strings.LastIndex(s, ",")
+	dot := strings.LastIndex(s, ".")
+	switch {
+	case comma >= 0 && dot >= 0 && comma < dot:
+		s = strings.Replace(s, ",", "", -1)
+	case comma >= 0 && dot >= 0:
+		s = strings.Replace(strings.Replace(s, ".", "", -1), ",", ".", 1)
+	case comma >= 0 && len(s)-comma-1 == 3:
+		s = strings.Replace(s, ",", "", -1)
+	case comma >= 0:
+		s = strings.Replace(s, ",", ".", 1)
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+func firstNumber(s string) string {
+	start := strings.IndexFunc(s, unicode.IsDigit)
+	if start < 0 {
+		return ""
+	}
+	end := strings.IndexFunc(s[start:], func(r rune) bool {
+		return !unicode.IsDigit(r) && r != ',' && r != '.'
+	})
+	if end < 0 {
+		return s[start:]
+	}
+	return s[start : start+end]
+}
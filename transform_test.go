@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInventory(t *testing.T) {
+	tests := []struct {
+		in    string
+		n     int
+		exact bool
+	}{
+		{"1,200", 1200, true},
+		{"35", 35, true},
+		{">1000", 1000, false},
+		{">= 50", 50, false},
+		{"500+", 500, false},
+		{"約300", 300, false},
+		{"1.5k", 1500, false},
+		{"2K", 2000, false},
+		{"3 M", 3000000, false},
+		{"35 in stock", 35, false},
+		{"In stock: 35 pcs", 35, false},
+		{"12.5", 13, false},
+		{"N/A", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		n, exact := parseInventory(tt.in)
+		if n != tt.n || exact != tt.exact {
+			t.Errorf("parseInventory(%q) = %d, %v; want %d, %v", tt.in, n, exact, tt.n, tt.exact)
+		}
+	}
+}
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		breaks   []PriceBreak
+		code     string
+	}{
+		{"0.52", "USD", []PriceBreak{{1, 0.52}}, "USD"},
+		{"1:0.52;10:0.45", "", []PriceBreak{{1, 0.52}, {10, 0.45}}, ""},
+		{"10+ $0.45 | 1+ $0.52", "", []PriceBreak{{1, 0.52}, {10, 0.45}}, "USD"},
+		{"NT$ 12,50", "", []PriceBreak{{1, 12.5}}, "TWD"},
+		{`[{"qty":100,"price":0.3},{"qty":1,"price":0.5}]`, "EUR", []PriceBreak{{1, 0.5}, {100, 0.3}}, "EUR"},
+		{"", "人民币", nil, "CNY"},
+	}
+	for _, tt := range tests {
+		breaks, code := parsePrice(tt.in, tt.currency)
+		if !reflect.DeepEqual(breaks, tt.breaks) || code != tt.code {
+			t.Errorf("parsePrice(%q, %q) = %v, %q; want %v, %q", tt.in, tt.currency, breaks, code, tt.breaks, tt.code)
+		}
+	}
+}
+
+func TestCurrencyCode(t *testing.T) {
+	saved := rates
+	defer func() { rates = saved }()
+	rates = newRateTable("USD", []ExchangeRate{{Currency: "XAU", Rate: 2000}})
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"usd", "USD"},
+		{"US$", "USD"},
+		{"$", "USD"},
+		{"NT$ 100", "TWD"},
+		{"HK$5", "HKD"},
+		{"JP¥ 300", "JPY"},
+		{"¥ 300", "CNY"},
+		{"chf", "CHF"},
+		{"TBD", ""},
+		{"n/a", ""},
+		{"pcs", ""},
+		{"xau", "XAU"},
+		{"12.00", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := currencyCode(tt.in); got != tt.want {
+			t.Errorf("currencyCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"1,234.50", 1234.5, true},
+		{"1.234,50", 1234.5, true},
+		{"0,52", 0.52, true},
+		{"1,200", 1200, true},
+		{"1 200", 1200, true},
+		{"abc", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseNumber(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseNumber(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}